@@ -1,101 +1,1579 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Build information, overridden at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "0.4"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 type proxy struct {
-	Scheme   string
-	Host     string
-	Region   string
-	Service  string
-	Verbose  bool
-	Prettify bool
-	Signer   *v4.Signer
+	Scheme                 string
+	Host                   string
+	Region                 string
+	Service                string
+	Verbose                bool
+	Prettify               bool
+	AllowedMethods         []string
+	ForwardOptions         bool
+	MethodOverrides        []string
+	MaxURILength           int
+	UserAgent              string
+	UpstreamAccept         string
+	SignHeaders            []string
+	FailClosed             bool
+	Credentials            *credentials.Credentials
+	Signer                 *v4.Signer
+	Client                 *http.Client
+	FollowRedirects        bool
+	PassthroughSigned      bool
+	Output                 io.Writer
+	AccessLog              *log.Logger
+	AuditLog               *log.Logger
+	Clock                  func() time.Time
+	MetaCache              *metaCache
+	LogTemplate            *template.Template
+	CompressMin            int
+	Identity               *callerIdentity
+	Recent                 *recentLog
+	MaxResponseBytes       int64
+	LogSignedHeaders       bool
+	RequireIndex           bool
+	ForwardClientIP        bool
+	maintenance            int32 // non-zero while in maintenance mode, accessed atomically
+	draining               int32 // non-zero once shutdown has begun, accessed atomically
+	MaintenanceMessage     string
+	MaintenanceRetryAfter  time.Duration
+	RoleHeader             string
+	Roles                  *roleSigners
+	LogQueryMaxBytes       int
+	DebugHeaders           bool
+	KbnWorkaround          bool
+	ReadyStatuses          []string
+	DiscardBody            []discardRule
+	ServerTiming           bool
+	outputMu               sync.Mutex // serializes pretty records written to Output
+	SearchTimeout          time.Duration
+	WriteTimeout           time.Duration
+	DefaultContentType     string
+	Authz                  *authzHook
+	LogBody                bool
+	Slow                   *slowLog
+	DefaultIndex           string
+	TraceBody              bool
+	MaxSearchResponseBytes int64
+	SearchResponsePaths    *regexp.Regexp
+	LogAuth                bool
+	ReadRole               string
+	WriteRole              string
+	OperationRoles         *roleSigners
+	Capture                *log.Logger
+	CaptureHeaders         []string
+	CaptureMaxBody         int
+	CaptureRedact          []*regexp.Regexp
+	UpstreamSlots          chan struct{}
+	Indent                 string
+	clusterName            atomic.Value // string, set while -cluster-name-header is on
+	MaxIndicesPerRequest   int
+	indices                atomic.Value // []string, set while MaxIndicesPerRequest is on
+	SlowlogMaxBody         int
+}
+
+// defaultLogTemplate renders the classic single line verbose output
+const defaultLogTemplate = ` -> {{.Method}}; {{.Remote}}; {{.Path}}; {{.Query}}; {{.Status}}; {{printf "%.3fs" .Took.Seconds}}; {{.Action}}{{with .Identity}}; {{.}}{{end}}{{with .SignedHeaders}}; {{.}}{{end}}{{with .Auth}}; {{.}}{{end}}{{with .Body}}; {{.}}{{end}}`
+
+// logEntry holds the fields logged for each proxied request, which are also
+// available to -log-template
+type logEntry struct {
+	Time          time.Time     `json:"time"`
+	Method        string        `json:"method"`
+	Path          string        `json:"path"`
+	Status        int           `json:"status"`
+	Took          time.Duration `json:"took_ns"`
+	Remote        string        `json:"remote"`
+	Query         string        `json:"query,omitempty"`
+	RequestID     string        `json:"request_id,omitempty"`
+	Bytes         int           `json:"bytes"`
+	Action        string        `json:"action"`
+	Identity      string        `json:"identity,omitempty"`
+	SignedHeaders string        `json:"signed_headers,omitempty"`
+	Auth          string        `json:"auth,omitempty"`
+	Upstream      string        `json:"upstream"`
+	Body          string        `json:"body,omitempty"`
+}
+
+// MarshalJSON embeds the query as a JSON object when it is valid JSON, so
+// that it can be indexed by field, and as a string otherwise
+func (e logEntry) MarshalJSON() ([]byte, error) {
+	type plain logEntry
+	v := struct {
+		plain
+		Query interface{} `json:"query,omitempty"`
+	}{plain: plain(e)}
+
+	if json.Valid([]byte(e.Query)) {
+		v.Query = json.RawMessage(e.Query)
+	} else if e.Query != "" {
+		v.Query = e.Query
+	}
+	return json.Marshal(v)
+}
+
+// recentLog keeps the last log entries in a fixed size ring buffer
+type recentLog struct {
+	mu      sync.Mutex
+	entries []logEntry
+	next    int
+	full    bool
+}
+
+func newRecentLog(size int) *recentLog {
+	return &recentLog{entries: make([]logEntry, size)}
+}
+
+func (l *recentLog) add(e logEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the buffered entries, oldest first
+func (l *recentLog) list() []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]logEntry{}, l.entries[:l.next]...)
+	}
+	return append(append([]logEntry{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+// callerIdentity caches the IAM identity requests are signed as. It is
+// looked up again through STS whenever the credentials change, and only
+// once per change even if the lookup fails.
+type callerIdentity struct {
+	mu          sync.Mutex
+	client      *sts.STS
+	creds       *credentials.Credentials
+	accessKeyID string
+	account     string
+	arn         string
+}
+
+func newCallerIdentity(sess *session.Session, creds *credentials.Credentials, region string) *callerIdentity {
+	return &callerIdentity{
+		client: sts.New(sess, &aws.Config{Credentials: creds, Region: aws.String(region)}),
+		creds:  creds,
+	}
+}
+
+// Get returns the account ID and ARN of the current credentials. On lookup
+// failures the last known identity is returned.
+func (c *callerIdentity) Get() (account, arn string) {
+	v, err := c.creds.Get()
+	if err != nil {
+		return "", ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v.AccessKeyID == c.accessKeyID {
+		return c.account, c.arn
+	}
+
+	c.accessKeyID = v.AccessKeyID
+	c.account, c.arn = "", ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := c.client.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		log.Printf("Failed resolving caller identity: %s\n", err)
+		return "", ""
+	}
+	c.account, c.arn = aws.StringValue(out.Account), aws.StringValue(out.Arn)
+	return c.account, c.arn
+}
+
+// metadataEndpoints are read-only cluster state APIs polled by dashboards
+var metadataEndpoints = regexp.MustCompile(`^/(_cluster/health|_cat/indices)(/|$)|/_mapping(/|$)`)
+
+// slowLog keeps the slowest requests of the last window, slowest first
+type slowLog struct {
+	mu      sync.Mutex
+	size    int
+	window  time.Duration
+	entries []logEntry
+}
+
+func newSlowLog(size int, window time.Duration) *slowLog {
+	return &slowLog{size: size, window: window}
+}
+
+// expire drops entries older than the window, the caller holds l.mu
+func (l *slowLog) expire(now time.Time) {
+	kept := l.entries[:0]
+	for _, e := range l.entries {
+		if now.Sub(e.Time) <= l.window {
+			kept = append(kept, e)
+		}
+	}
+	l.entries = kept
+}
+
+func (l *slowLog) add(e logEntry, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(now)
+	i := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].Took < e.Took })
+	if i >= l.size {
+		return
+	}
+	l.entries = append(l.entries, logEntry{})
+	copy(l.entries[i+1:], l.entries[i:])
+	l.entries[i] = e
+	if len(l.entries) > l.size {
+		l.entries = l.entries[:l.size]
+	}
+}
+
+func (l *slowLog) list(now time.Time) []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(now)
+	return append([]logEntry{}, l.entries...)
+}
+
+// metaCache keeps successful responses of metadataEndpoints for a short
+// time so repeated polling doesn't reach ES
+type metaCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]metaCacheEntry
+}
+
+type metaCacheEntry struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newMetaCache(ttl time.Duration) *metaCache {
+	return &metaCache{ttl: ttl, entries: make(map[string]metaCacheEntry)}
+}
+
+func (c *metaCache) get(key string, now time.Time) (metaCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && now.After(e.expires) {
+		delete(c.entries, key)
+		return e, false
+	}
+	return e, ok
+}
+
+func (c *metaCache) set(key string, header http.Header, body []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = metaCacheEntry{header: header, body: body, expires: now.Add(c.ttl)}
+}
+
+// cacheKey returns the metadata cache key for r, or "" if r can't be cached.
+// Responses are cached per role, as each role may see different data.
+func (p *proxy) cacheKey(r *http.Request, role string) string {
+	if p.MetaCache == nil || r.Method != http.MethodGet || !metadataEndpoints.MatchString(r.URL.Path) {
+		return ""
+	}
+	// Only ES can tell whether the client's own signature is valid
+	if p.PassthroughSigned && clientSigned(r) {
+		return ""
+	}
+	return role + " " + r.URL.RequestURI()
+}
+
+// authzHook asks an external service whether a request may be forwarded.
+// Decisions are kept for ttl so repeated requests don't all hit the hook.
+type authzHook struct {
+	url       string
+	headers   []string
+	ttl       time.Duration
+	client    *http.Client
+	mu        sync.Mutex
+	decisions map[string]authzDecision
+}
+
+type authzDecision struct {
+	status  int
+	expires time.Time
+}
+
+// authzRequest is the request metadata POSTed to the hook
+type authzRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Remote  string            `json:"remote"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func newAuthzHook(url string, headers []string, ttl time.Duration) *authzHook {
+	return &authzHook{
+		url:       url,
+		headers:   headers,
+		ttl:       ttl,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		decisions: make(map[string]authzDecision),
+	}
+}
+
+// check returns the status the hook answered r with
+func (h *authzHook) check(r *http.Request, now time.Time) (int, error) {
+	ar := authzRequest{Method: r.Method, Path: r.URL.RequestURI(), Remote: r.RemoteAddr}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ar.Remote = ip
+	}
+	for _, name := range h.headers {
+		if v := r.Header.Get(name); v != "" {
+			if ar.Headers == nil {
+				ar.Headers = make(map[string]string)
+			}
+			ar.Headers[name] = v
+		}
+	}
+	payload, err := json.Marshal(ar)
+	if err != nil {
+		return 0, err
+	}
+
+	// Identical metadata gets the same answer, so it doubles as the key
+	key := string(payload)
+	h.mu.Lock()
+	d, ok := h.decisions[key]
+	h.mu.Unlock()
+	if ok && now.Before(d.expires) {
+		return d.status, nil
+	}
+
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for k, d := range h.decisions {
+		if now.After(d.expires) {
+			delete(h.decisions, k)
+		}
+	}
+	h.decisions[key] = authzDecision{status: resp.StatusCode, expires: now.Add(h.ttl)}
+	return resp.StatusCode, nil
+}
+
+// redactCapture masks every match of CaptureRedact in s
+func (p *proxy) redactCapture(s string) string {
+	for _, re := range p.CaptureRedact {
+		s = re.ReplaceAllLiteralString(s, "[REDACTED]")
+	}
+	return s
+}
+
+// captureRecord is a single line of the capture file, holding what is
+// needed to send the request again
+type captureRecord struct {
+	Time        string            `json:"time"`
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	BodyBytes   int               `json:"body_bytes"`
+	BodyOmitted bool              `json:"body_omitted,omitempty"`
 }
 
+// auditRecord is a single line of the audit log
+type auditRecord struct {
+	Time       string `json:"time"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remote_addr"`
+	RequestID  string `json:"request_id,omitempty"`
+	BodySHA256 string `json:"body_sha256"`
+	Status     int    `json:"status"`
+}
+
+// parseIndent turns the -indent flag into the indentation string
+func parseIndent(value string) string {
+	if value == "tab" {
+		return "\t"
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("ERROR: Invalid -indent %q, use a number of spaces or tab\n", value)
+	}
+	return strings.Repeat(" ", n)
+}
+
+// audit records a write request which was forwarded upstream in the audit
+// log. status is the one ES answered with, or the one the proxy answered
+// with if there was no response.
+func (p *proxy) audit(r *http.Request, body []byte, status int, started time.Time) {
+	if p.AuditLog == nil || !isWriteRequest(r.Method, r.URL.Path) {
+		return
+	}
+	sum := sha256.Sum256(body)
+	record, _ := json.Marshal(auditRecord{
+		Time:       started.UTC().Format(time.RFC3339),
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		RemoteAddr: r.RemoteAddr,
+		RequestID:  r.Header.Get("X-Request-Id"),
+		BodySHA256: hex.EncodeToString(sum[:]),
+		Status:     status,
+	})
+	p.AuditLog.Println(string(record))
+}
+
+// truncate shortens b to at most max bytes plus an ellipsis, without
+// splitting a UTF-8 character. A max of 0 leaves b untouched.
+func truncate(b []byte, max int) []byte {
+	if max <= 0 || len(b) <= max {
+		return b
+	}
+	for max > 0 && !utf8.RuneStart(b[max]) {
+		max--
+	}
+	return append(b[:max:max], "..."...)
+}
+
+// formatBody renders a request body for prettified verbose output: JSON is
+// indented by indent, ndjson (e.g. _bulk) is summarized and binary data
+// only sized
+func formatBody(contentType string, body []byte, indent string) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/x-ndjson" {
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", indent) == nil {
+			return pretty.String()
+		}
+	}
+
+	if mediaType == "application/x-ndjson" || isNDJSON(body) {
+		lines := bytes.Count(bytes.TrimSpace(body), []byte("\n")) + 1
+		return fmt.Sprintf("(ndjson, %d lines, %d bytes)", lines, len(body))
+	}
+	if utf8.Valid(body) {
+		return string(body)
+	}
+	return fmt.Sprintf("(binary %s, %d bytes)", mediaType, len(body))
+}
+
+// decodedBody returns a gzip encoded response body decompressed, for
+// logging only. Bodies which fail to decompress are returned unchanged.
+func decodedBody(header http.Header, body []byte) []byte {
+	if !strings.EqualFold(header.Get("Content-Encoding"), "gzip") {
+		return body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return body
+	}
+	decoded, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// singleLine returns body as a single line, compacting JSON and joining
+// the lines of anything else
+func singleLine(body []byte) string {
+	var compact bytes.Buffer
+	if json.Compact(&compact, body) == nil {
+		return compact.String()
+	}
+	return strings.Replace(strings.TrimSpace(string(body)), "\n", " ", -1)
+}
+
+// isNDJSON reports whether every non-empty line of body is a JSON value
+func isNDJSON(body []byte) bool {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 && !json.Valid(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// classifyAction names the kind of ES operation a request performs, based
+// on its method and the API named in its path
+func classifyAction(method, path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if segments[0] == "" {
+		return "info"
+	}
+
+	// Cluster level APIs are named by their first segment
+	switch segments[0] {
+	case "_cat":
+		return "cat"
+	case "_cluster":
+		return "cluster"
+	case "_nodes":
+		return "nodes"
+	case "_snapshot":
+		return "snapshot"
+	case "_tasks":
+		return "tasks"
+	}
+
+	// Otherwise the last API segment decides, e.g. /index/_search/template
+	for i := len(segments) - 1; i >= 0; i-- {
+		switch segments[i] {
+		case "_bulk":
+			return "bulk"
+		case "_search", "_msearch":
+			return "search"
+		case "_count":
+			return "count"
+		case "_mget", "_source":
+			return "get"
+		case "_update", "_update_by_query":
+			return "update"
+		case "_delete_by_query":
+			return "delete"
+		case "_mapping", "_mappings":
+			return "mapping"
+		case "_settings":
+			return "settings"
+		case "_alias", "_aliases":
+			return "alias"
+		case "_refresh", "_flush", "_forcemerge":
+			return "maintenance"
+		}
+		if strings.HasPrefix(segments[i], "_") && segments[i] != "_doc" && segments[i] != "_create" {
+			return strings.TrimPrefix(segments[i], "_")
+		}
+	}
+
+	// Document and index APIs, e.g. /index/_doc/1
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return "get"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return "index"
+}
+
+// targetsIndex reports whether path names an index ahead of the API, e.g.
+// /logs/_search as opposed to /_search or /_cluster/health
+func targetsIndex(path string) bool {
+	first := strings.SplitN(strings.Trim(path, "/"), "/", 2)[0]
+	return first != "" && !strings.HasPrefix(first, "_")
+}
+
+// readOnlyEndpoints are APIs which accept POST without modifying data
+var readOnlyEndpoints = regexp.MustCompile(`/(_search|_msearch|_count|_mget|_explain|_validate|_field_caps|_analyze|_search_shards)(/|$)`)
+
+// isWriteRequest reports whether a request modifies data in the cluster
+func isWriteRequest(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	case http.MethodPost:
+		return !readOnlyEndpoints.MatchString(path)
+	}
+	return true
+}
+
+// stringSlice is a flag.Value collecting every occurrence of a repeatable flag
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// bufferedWriter collects writes in memory and flushes them to the
+// underlying writer on a fixed interval, trading log latency for fewer
+// syscalls under high request rates.
+type bufferedWriter struct {
+	mu  sync.Mutex
+	buf *bufio.Writer
+}
+
+func newBufferedWriter(w io.Writer, interval time.Duration) *bufferedWriter {
+	b := &bufferedWriter{buf: bufio.NewWriter(w)}
+	go func() {
+		for range time.Tick(interval) {
+			b.Flush()
+		}
+	}()
+	return b
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *bufferedWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Flush()
+}
+
+// perIPListener caps the number of connections open at once from a single
+// client IP. Connections over the limit are reset as soon as they are
+// accepted.
+type perIPListener struct {
+	net.Listener
+	max   int
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newPerIPListener(l net.Listener, max int) *perIPListener {
+	return &perIPListener{Listener: l, max: max, conns: make(map[string]int)}
+}
+
+func (l *perIPListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		l.mu.Lock()
+		if l.conns[ip] >= l.max {
+			l.mu.Unlock()
+			if tc, ok := c.(*net.TCPConn); ok {
+				tc.SetLinger(0)
+			}
+			c.Close()
+			continue
+		}
+		l.conns[ip]++
+		l.mu.Unlock()
+
+		return &countedConn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *perIPListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[ip]--
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// countedConn gives its slot in a perIPListener back once closed
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// systemdListener returns the socket passed in by systemd socket
+// activation, or nil if the process wasn't socket activated
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// Passed file descriptors start right after stdin, stdout and stderr
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// statusWriter remembers the status code sent to the client
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// copyHeaders adds the values of src to dst. Keys are taken as they are,
+// they are already canonical in headers parsed by net/http.
 func copyHeaders(dst, src http.Header) {
 	for k, vals := range src {
-		for _, v := range vals {
-			dst.Add(k, v)
-		}
+		dst[k] = append(dst[k], vals...)
 	}
 }
 
+// replaceBody buffers the request body so it can be hashed for signing and
+// still be sent upstream. Empty bodies are dropped altogether, so a nil and
+// an empty body both sign the hash of the empty string and go out with a
+// zero Content-Length instead of a chunked transfer.
+//
+// The upstream framing always comes from the buffered body, never from the
+// client's headers. net/http has already answered 400 or 501 to requests
+// with conflicting Content-Length values or an unknown Transfer-Encoding,
+// and dropped Content-Length when the body was chunked.
 func replaceBody(req *http.Request) []byte {
 	if req.Body == nil {
+		req.ContentLength = 0
 		return []byte{}
 	}
 	payload, _ := ioutil.ReadAll(req.Body)
+	req.ContentLength = int64(len(payload))
+	if len(payload) == 0 {
+		req.Body = nil
+		return payload
+	}
 	req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(payload)), nil
+	}
 	return payload
 }
 
-func parseEndpoint(endpoint string, p *proxy) {
-	link, err := url.Parse(endpoint)
-	if err != nil {
-		log.Fatalf("ERROR: Failed parsing endpoint: %s\n", endpoint)
+// compressBody replaces the request body with its gzip encoding and
+// returns the compressed bytes, which are what has to be signed
+func compressBody(req *http.Request, body []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Body = ioutil.NopCloser(&buf)
+	return replaceBody(req)
+}
+
+// containsFold reports whether list holds s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// methodAllowed reports whether method may pass through the proxy.
+// An empty allow list means every method is allowed.
+func (p *proxy) methodAllowed(method string) bool {
+	return len(p.AllowedMethods) == 0 || containsFold(p.AllowedMethods, method)
+}
+
+// ecsCredentialsHost is the container credentials endpoint on ECS and Fargate
+const ecsCredentialsHost = "http://169.254.170.2"
+
+// ecsCredentials fetches the task role credentials from the container
+// credentials endpoint at host, normally ecsCredentialsHost. They are
+// refreshed shortly before the expiry the endpoint reports for them.
+func ecsCredentials(sess *session.Session, host string) (*credentials.Credentials, error) {
+	uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	if uri == "" {
+		return nil, errors.New("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is not set, not running on ECS?")
+	}
+
+	return endpointcreds.NewCredentialsClient(*sess.Config, sess.Handlers, host+uri,
+		func(p *endpointcreds.Provider) {
+			p.ExpiryWindow = 5 * time.Minute
+		}), nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// resolvingDialer dials the addresses configured with -resolve instead of
+// looking up their host names. TLS and signing still use the host name.
+func resolvingDialer(entries []string, dial dialFunc) dialFunc {
+	hosts := make(map[string]string)
+	for _, e := range entries {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 || net.ParseIP(parts[1]) == nil {
+			log.Fatalf("ERROR: Invalid -resolve entry %q, expected host:ip\n", e)
+		}
+		hosts[parts[0]] = parts[1]
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if ip, ok := hosts[host]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// delayingDialer turns off TCP_NODELAY, which Go sets by default, on the
+// connections dial opens
+func delayingDialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetNoDelay(false)
+		}
+		return c, err
+	}
+}
+
+// discardRule selects requests whose response body is not sent back
+type discardRule struct {
+	method string
+	path   *regexp.Regexp
+}
+
+func parseDiscardRules(entries []string) []discardRule {
+	var rules []discardRule
+	for _, e := range entries {
+		parts := strings.SplitN(e, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("ERROR: Invalid -discard-body-for entry %q, expected METHOD:path-regexp\n", e)
+		}
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			log.Fatalf("ERROR: Invalid -discard-body-for path in %q: %s\n", e, err)
+		}
+		rules = append(rules, discardRule{method: strings.ToUpper(parts[0]), path: re})
+	}
+	return rules
+}
+
+func (p *proxy) discardsBody(method, path string) bool {
+	for _, rule := range p.DiscardBody {
+		if (rule.method == "*" || rule.method == method) && rule.path.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// certPool returns the system roots with the certificates in files added,
+// so public endpoints keep working next to ones signed by a private CA
+func certPool(files []string) *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		log.Printf("WARNING: Failed loading system CA certificates, only trusting -ca-cert: %s\n", err)
+		pool = x509.NewCertPool()
+	}
+	for _, file := range files {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatalf("ERROR: Failed reading CA certificates: %s\n", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("ERROR: No PEM certificates found in %s\n", file)
+		}
+	}
+	return pool
+}
+
+// dashboardHeaders are the version and XSRF headers sent by Kibana and
+// OpenSearch Dashboards which have to reach the cluster
+var dashboardHeaders = []string{"Kbn-Version", "Kbn-Xsrf", "Osd-Version", "Osd-Xsrf"}
+
+// signatureMismatch matches AWS errors caused by signing for the wrong scope
+var signatureMismatch = regexp.MustCompile(`SignatureDoesNotMatch|Credential should be scoped to a valid region`)
+
+// sourceCredentials returns credentials from a single source, bypassing
+// the precedence of the default credentials chain. Profile credentials are
+// read from file, or the default shared credentials file if it is empty.
+func sourceCredentials(sess *session.Session, source, file, profile string) *credentials.Credentials {
+	switch source {
+	case "env":
+		return credentials.NewEnvCredentials()
+	case "profile":
+		return credentials.NewSharedCredentials(file, profile)
+	case "ec2":
+		return ec2rolecreds.NewCredentialsWithClient(ec2metadata.New(sess))
+	case "ecs":
+		creds, err := ecsCredentials(sess, ecsCredentialsHost)
+		if err != nil {
+			log.Fatalf("ERROR: %s\n", err)
+		}
+		return creds
+	case "web-identity":
+		return stscreds.NewWebIdentityCredentials(sess, os.Getenv("AWS_ROLE_ARN"),
+			os.Getenv("AWS_ROLE_SESSION_NAME"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	}
+	log.Fatalf("ERROR: Unknown credentials source %q, use env, profile, ec2, ecs or web-identity\n", source)
+	return nil
+}
+
+// knownServices are the signing names of the Amazon ES/OpenSearch services
+var knownServices = map[string]bool{
+	"es":   true,
+	"aoss": true,
+}
+
+func parseEndpoint(endpoint string, p *proxy) {
+	link, err := url.Parse(endpoint)
+	if err != nil {
+		log.Fatalf("ERROR: Failed parsing endpoint: %s\n", endpoint)
+	}
+
+	// Only http/https are supported schemes
+	scheme := func(x string) string {
+		switch x {
+		case "http", "https":
+			return x
+		}
+		return "https"
+	}
+	link.Scheme = scheme(link.Scheme)
+
+	// Unkown schemes sometimes result in empty host value
+	if link.Host == "" {
+		log.Fatalf("ERROR: Empty host information in submitted endpoint (%s)\n", endpoint)
+	}
+
+	p.Scheme = link.Scheme
+	p.Host = link.Host
+
+	// Region and service given on the command line take precedence, which
+	// also allows signing for hosts that don't follow the ES naming scheme
+	parts := strings.Split(link.Host, ".")
+	if len(parts) == 5 {
+		if p.Region == "" {
+			p.Region = parts[1]
+		}
+		if p.Service == "" {
+			p.Service = parts[2]
+		}
+	}
+
+	// Fall back to the region the AWS SDKs would pick
+	if p.Region == "" {
+		p.Region = os.Getenv("AWS_REGION")
+	}
+	if p.Region == "" {
+		p.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	if p.Region == "" || p.Service == "" {
+		log.Fatalln("ERROR: Submitted endpoint is not a valid Amazon ElasticSearch Endpoint, use -region and -service to sign for other hosts")
+	}
+}
+
+// lookupTimeout bounds the requests the proxy sends upstream on its own,
+// so a hanging cluster can't pile them up
+const lookupTimeout = 5 * time.Second
+
+// getJSON sends a signed GET for path to the endpoint and decodes the JSON
+// response into v. It gives up after lookupTimeout or once ctx is done.
+func (p *proxy) getJSON(ctx context.Context, path string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Scheme+"://"+p.Host+path, nil)
+	if err != nil {
+		return err
+	}
+	if p.UserAgent != "" {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+	p.signRequest(req, bytes.NewReader(nil))
+
+	resp, err := p.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// refreshClusterName looks up the name of the cluster behind the endpoint.
+// The last known name is kept if that fails.
+func (p *proxy) refreshClusterName() {
+	var info struct {
+		ClusterName string `json:"cluster_name"`
+	}
+	if err := p.getJSON(context.Background(), "/", &info); err != nil {
+		log.Printf("Failed looking up the cluster name: %s\n", err)
+		return
+	}
+	p.clusterName.Store(info.ClusterName)
+}
+
+// refreshIndices loads the names of all indices in the cluster. The last
+// known list is kept if that fails.
+func (p *proxy) refreshIndices() {
+	var rows []struct {
+		Index string `json:"index"`
+	}
+	if err := p.getJSON(context.Background(), "/_cat/indices?format=json&h=index", &rows); err != nil {
+		log.Printf("Failed listing indices: %s\n", err)
+		return
+	}
+	names := make([]string, 0, len(rows))
+	for _, row := range rows {
+		names = append(names, row.Index)
+	}
+	p.indices.Store(names)
+}
+
+// countIndices returns how many of names the comma separated index
+// expression matches. _all and wildcards are resolved against names, other
+// entries count as one index each and exclusions are ignored.
+func countIndices(expr string, names []string) int {
+	matched := make(map[string]bool)
+	for _, pattern := range strings.Split(expr, ",") {
+		switch {
+		case pattern == "" || strings.HasPrefix(pattern, "-"):
+		case pattern == "_all":
+			for _, name := range names {
+				matched[name] = true
+			}
+		case !strings.ContainsAny(pattern, "*?"):
+			matched[pattern] = true
+		default:
+			for _, name := range names {
+				if ok, _ := path.Match(pattern, name); ok {
+					matched[name] = true
+				}
+			}
+		}
+	}
+	return len(matched)
+}
+
+// serveReady answers readiness probes with the cluster health: 200 if its
+// status is one of ReadyStatuses, 503 otherwise or while shutting down
+func (p *proxy) serveReady(w http.ResponseWriter, r *http.Request) {
+	notReady := func(reason string) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(reason))
+	}
+
+	if p.isDraining() {
+		notReady("proxy is shutting down")
+		return
+	}
+
+	if p.FailClosed {
+		if err := p.credentialsAvailable(); err != nil {
+			notReady("AWS credentials are unavailable: " + err.Error())
+			return
+		}
+	}
+
+	// Probes are retried anyway, don't let them wait on a hanging cluster
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := p.getJSON(r.Context(), "/_cluster/health", &health); err != nil {
+		notReady("cluster health is unavailable: " + err.Error())
+		return
+	}
+
+	if !containsFold(p.ReadyStatuses, health.Status) {
+		notReady("cluster status is " + health.Status)
+		return
+	}
+	w.Write([]byte("cluster status is " + health.Status))
+}
+
+// setMaintenance switches maintenance mode on or off
+func (p *proxy) setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&p.maintenance, v)
+}
+
+func (p *proxy) inMaintenance() bool {
+	return atomic.LoadInt32(&p.maintenance) != 0
+}
+
+// startDraining fails readiness probes from now on, ahead of shutdown
+func (p *proxy) startDraining() {
+	atomic.StoreInt32(&p.draining, 1)
+}
+
+func (p *proxy) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) != 0
+}
+
+// now reads the time from Clock, falling back to the wall clock
+func (p *proxy) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock()
+}
+
+// signRequest signs req with AWSv4. When SignHeaders is set, any other
+// header is kept out of the SignedHeaders list and re-attached after
+// signing, so headers rewritten further down the line can't invalidate
+// the signature.
+func (p *proxy) signRequest(req *http.Request, body io.ReadSeeker) {
+	unsigned := http.Header{}
+	if len(p.SignHeaders) > 0 {
+		for k, vals := range req.Header {
+			if !p.signsHeader(k) {
+				unsigned[k] = vals
+				req.Header.Del(k)
+			}
+		}
+	}
+
+	signer := p.Signer
+	if s, ok := req.Context().Value(signerKey{}).(*v4.Signer); ok {
+		signer = s
+	}
+	signer.Sign(req, body, p.Service, p.Region, p.now())
+	copyHeaders(req.Header, unsigned)
+}
+
+// signerKey is the request context key for a signer overriding the
+// proxy's default one, e.g. one selected with -role-header
+type signerKey struct{}
+
+// passthroughKey is the request context key marking requests forwarded
+// with the client's own signature
+type passthroughKey struct{}
+
+// roleSigners hands out signers for the IAM roles clients may ask for,
+// assuming each role on first use. The credentials of every assumed role
+// are cached and refreshed independently.
+type roleSigners struct {
+	mu      sync.Mutex
+	sess    *session.Session
+	allowed []string
+	options []func(*v4.Signer)
+	signers map[string]*v4.Signer
+}
+
+func newRoleSigners(sess *session.Session, allowed []string, options []func(*v4.Signer)) *roleSigners {
+	return &roleSigners{
+		sess:    sess,
+		allowed: allowed,
+		options: options,
+		signers: make(map[string]*v4.Signer),
+	}
+}
+
+// get returns the signer for role, or false if role isn't allowed
+func (rs *roleSigners) get(role string) (*v4.Signer, bool) {
+	allowed := false
+	for _, a := range rs.allowed {
+		if a == role {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, false
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	signer, ok := rs.signers[role]
+	if !ok {
+		signer = v4.NewSigner(stscreds.NewCredentials(rs.sess, role), rs.options...)
+		rs.signers[role] = signer
+	}
+	return signer, true
+}
+
+// expire marks the credentials of every role assumed so far as expired, so
+// the role is assumed again on its next use
+func (rs *roleSigners) expire() {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, signer := range rs.signers {
+		signer.Credentials.Expire()
+	}
+}
+
+// credentialsAvailable reports whether non-empty AWS credentials can
+// currently be obtained for signing.
+func (p *proxy) credentialsAvailable() error {
+	v, err := p.Credentials.Get()
+	if err != nil {
+		return err
+	}
+	if v.AccessKeyID == "" || v.SecretAccessKey == "" {
+		return fmt.Errorf("empty AWS credentials from %s", v.ProviderName)
+	}
+	return nil
+}
+
+// copySignature copies an AWSv4 signature and the headers it covers from
+// the client request r to req. It reports false if r isn't signed.
+func copySignature(req, r *http.Request) bool {
+	if !clientSigned(r) {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	req.Header.Set("Authorization", auth)
+
+	for _, h := range []string{"X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Content-Sha256"} {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+
+	for _, name := range strings.Split(signedHeaders(auth), ";") {
+		if vals, ok := r.Header[http.CanonicalHeaderKey(name)]; ok && name != "host" {
+			req.Header[http.CanonicalHeaderKey(name)] = vals
+		}
+	}
+	return true
+}
+
+// clientSigned reports whether r carries an AWSv4 signature of its own
+func clientSigned(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+}
+
+// signedHeaders extracts the semicolon separated list of signed header
+// names from an AWSv4 Authorization header, e.g.
+// "AWS4-HMAC-SHA256 Credential=..., SignedHeaders=host;x-amz-date, Signature=..."
+func signedHeaders(auth string) string {
+	i := strings.Index(auth, "SignedHeaders=")
+	if i < 0 {
+		return ""
+	}
+	names := auth[i+len("SignedHeaders="):]
+	if j := strings.Index(names, ","); j >= 0 {
+		names = names[:j]
+	}
+	return names
+}
+
+// authAlgorithm returns the scheme of an Authorization header, e.g.
+// AWS4-HMAC-SHA256, or "none" when there is no header
+func authAlgorithm(auth string) string {
+	if fields := strings.Fields(auth); len(fields) > 0 {
+		return fields[0]
+	}
+	return "none"
+}
+
+// do sends req upstream. Should a read fail on a reused keep-alive
+// connection, typically one the upstream dropped while idle, it is sent
+// once more on a fresh connection. Writes are never sent again, ES may
+// have applied them before the connection dropped.
+func (p *proxy) do(req *http.Request) (*http.Response, error) {
+	var reused bool
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
 	}
 
-	// Only http/https are supported schemes
-	scheme := func(x string) string {
-		switch x {
-		case "http", "https":
-			return x
-		}
-		return "https"
+	resp, err := p.Client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil || !reused || isWriteRequest(req.Method, req.URL.Path) || !(errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+		return resp, err
 	}
-	link.Scheme = scheme(link.Scheme)
 
-	// Unkown schemes sometimes result in empty host value
-	if link.Host == "" {
-		log.Fatalf("ERROR: Empty host information in submitted endpoint (%s)\n", endpoint)
+	log.Printf("Retrying %s after the upstream closed a reused connection\n", req.URL.RequestURI())
+	if req.GetBody != nil {
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
 	}
+	return p.Client.Do(req)
+}
 
-	// Extract region and service from link
-	parts := strings.Split(link.Host, ".")
-	var region, service string
+// requestTimeout is how long a request may take upstream, including
+// reading the response, depending on the kind of operation. Zero means no
+// limit.
+func (p *proxy) requestTimeout(method, path string) time.Duration {
+	if isWriteRequest(method, path) {
+		return p.WriteTimeout
+	}
+	switch classifyAction(method, path) {
+	case "search", "count":
+		return p.SearchTimeout
+	}
+	return 0
+}
 
-	if len(parts) == 5 {
-		region, service = parts[1], parts[2]
-	} else {
-		log.Fatalln("ERROR: Submitted endpoint is not a valid Amazon ElasticSearch Endpoint")
+// checkRedirect follows redirects within the configured endpoint, signing
+// them again for the new location. Any other redirect is handed back to
+// the client unfollowed, as following it unsigned would fail anyway. So
+// are redirects of requests signed by the client, which must never be
+// signed as the proxy.
+func (p *proxy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if !p.FollowRedirects || req.URL.Host != p.Host || len(via) >= 10 {
+		return http.ErrUseLastResponse
+	}
+	if req.Context().Value(passthroughKey{}) != nil {
+		return http.ErrUseLastResponse
 	}
 
-	// Build proxy struct
-	p.Scheme = link.Scheme
-	p.Host = link.Host
-	p.Region = region
-	p.Service = service
+	// Drop the signature of the original request
+	for _, h := range []string{"Authorization", "X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Content-Sha256"} {
+		req.Header.Del(h)
+	}
+	p.signRequest(req, bytes.NewReader(replaceBody(req)))
+	return nil
+}
 
+func (p *proxy) signsHeader(name string) bool {
+	return containsFold(p.SignHeaders, name)
 }
 
 func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	requestStarted := time.Now()
-	dump, err := httputil.DumpRequest(r, true)
+	ctx, endSpan := startSpan(r)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	defer func() { endSpan(sw.status) }()
+	w, r = sw, r.WithContext(ctx)
+
+	requestStarted := p.now()
+	dump, dumpErr := httputil.DumpRequest(r, true)
 	defer r.Body.Close()
+	if dumpErr != nil {
+		// Still proxy the request, only leave its body out of the logs
+		log.Printf("Failed dumping request for logging: %s\n", dumpErr)
+	}
+
+	// Tag every response, including errors, with the serving build
+	w.Header().Set("X-Aws-Es-Proxy-Version", version)
 
 	respondError := func(err error) {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 	}
 
+	// Clients limited to GET/POST can ask for another method, as long as
+	// it has been allowed with -method-override
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		if !containsFold(p.MethodOverrides, override) {
+			respondError(fmt.Errorf("Method override to %s is not allowed", override))
+			return
+		}
+		r.Method = strings.ToUpper(override)
+	}
+
+	// Scroll continuations never name an index, so they are left alone here
+	// and always let through below
+	if p.DefaultIndex != "" && !targetsIndex(r.URL.Path) && !strings.HasPrefix(r.URL.Path, "/_search/scroll") {
+		switch classifyAction(r.Method, r.URL.Path) {
+		case "search", "count":
+			r.URL.Path = "/" + p.DefaultIndex + r.URL.Path
+			r.URL.RawPath = ""
+		}
+	}
+
+	// Without an answer from the hook nothing is let through, not even the
+	// proxy's own endpoints, which expose other clients' requests. It is
+	// asked about the request as it will be sent upstream.
+	if p.Authz != nil {
+		status, err := p.Authz.check(r, p.now())
+		if err != nil {
+			log.Printf("Authorization hook failed for %s: %s\n", r.URL.RequestURI(), err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Authorization hook is unavailable"))
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	if p.Recent != nil && r.Method == http.MethodGet && r.URL.Path == "/_recent" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Recent.list())
+		return
+	}
+
+	if p.Slow != nil && r.Method == http.MethodGet && r.URL.Path == "/_slowlog" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Slow.list(p.now()))
+		return
+	}
+
+	if r.Method == http.MethodGet && r.URL.Path == "/_ready" {
+		p.serveReady(w, r)
+		return
+	}
+
+	if p.inMaintenance() {
+		if p.MaintenanceRetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(p.MaintenanceRetryAfter.Seconds())))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(p.MaintenanceMessage))
+		return
+	}
+
+	if !p.methodAllowed(r.Method) {
+		w.Header().Set("Allow", strings.ToUpper(strings.Join(p.AllowedMethods, ", ")))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(fmt.Sprintf("Method %s is not allowed by the proxy", r.Method)))
+		return
+	}
+
+	if p.MaxURILength > 0 && len(r.URL.RequestURI()) > p.MaxURILength {
+		w.WriteHeader(http.StatusRequestURITooLong)
+		w.Write([]byte(fmt.Sprintf("Request URI exceeds %d bytes", p.MaxURILength)))
+		return
+	}
+
+	// Answer OPTIONS (e.g. CORS preflights) locally instead of signing
+	// and forwarding them
+	if r.Method == http.MethodOptions && !p.ForwardOptions {
+		allow := "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+		if len(p.AllowedMethods) > 0 {
+			allow = strings.ToUpper(strings.Join(p.AllowedMethods, ", "))
+		}
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if p.FailClosed {
+		if err := p.credentialsAvailable(); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("AWS credentials are unavailable, refusing to forward unsigned request: " + err.Error()))
+			return
+		}
+	}
+
+	if p.RequireIndex && !targetsIndex(r.URL.Path) && !strings.HasPrefix(r.URL.Path, "/_search/scroll") {
+		switch classifyAction(r.Method, r.URL.Path) {
+		case "search", "count":
+			respondError(fmt.Errorf("Requests to %s must name an index", r.URL.Path))
+			return
+		}
+	}
+
+	// Requests are let through until the index list has been loaded.
+	// Searches naming no index run against all of them.
+	if names, ok := p.indices.Load().([]string); ok {
+		expr := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)[0]
+		if !targetsIndex(r.URL.Path) && expr != "_all" {
+			expr = ""
+			switch classifyAction(r.Method, r.URL.Path) {
+			case "search", "count":
+				if !strings.HasPrefix(r.URL.Path, "/_search/scroll") {
+					expr = "_all"
+				}
+			}
+		}
+		if n := countIndices(expr, names); n > p.MaxIndicesPerRequest {
+			respondError(fmt.Errorf("%s matches %d indices, more than the limit of %d", expr, n, p.MaxIndicesPerRequest))
+			return
+		}
+	}
+
+	// The role is checked before anything is answered on the client's
+	// behalf, cached responses included
+	var role string
+	var roleSigner *v4.Signer
+	if p.RoleHeader != "" {
+		if role = r.Header.Get(p.RoleHeader); role != "" {
+			var ok bool
+			if roleSigner, ok = p.Roles.get(role); !ok {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(fmt.Sprintf("Role %s is not allowed", role)))
+				return
+			}
+		}
+	}
+
+	cacheKey := p.cacheKey(r, role)
+	if cacheKey != "" {
+		if e, ok := p.MetaCache.get(cacheKey, p.now()); ok {
+			copyHeaders(w.Header(), e.header)
+			w.WriteHeader(http.StatusOK)
+			w.Write(e.body)
+			return
+		}
+	}
+
 	endpoint := *r.URL
 	endpoint.Host = p.Host
 	endpoint.Scheme = p.Scheme
@@ -106,36 +1584,237 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Workaround for ES 5.1 and Kibana 5.1.1
-	if val, ok := r.Header["Kbn-Version"]; ok {
-		req.Header.Set("Kbn-Version", val[0])
+	// Workaround for ES 5.1 and Kibana 5.1.1, extended to later Kibana
+	// and OpenSearch Dashboards versions
+	if p.KbnWorkaround {
+		for _, h := range dashboardHeaders {
+			if val, ok := r.Header[h]; ok {
+				req.Header[h] = val
+			}
+		}
+	}
+
+	if p.UserAgent != "" {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+
+	// Set before signing so the header is covered by the signature
+	if p.UpstreamAccept != "" {
+		req.Header.Set("Accept", p.UpstreamAccept)
+	}
+
+	injectTrace(r.Context(), req.Header)
+
+	// Append the client to any X-Forwarded-For chain it came with
+	if p.ForwardClientIP {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+				ip = prior + ", " + ip
+			}
+			req.Header.Set("X-Forwarded-For", ip)
+		}
+	}
+
+	// Reads and writes may each be signed as a role of their own. signedAs
+	// is the role ARN used, empty for the proxy's own identity.
+	var signedAs string
+	opRole := p.ReadRole
+	if isWriteRequest(r.Method, r.URL.Path) {
+		opRole = p.WriteRole
+	}
+	if opRole != "" {
+		signer, _ := p.OperationRoles.get(opRole)
+		req = req.WithContext(context.WithValue(req.Context(), signerKey{}, signer))
+		signedAs = opRole
+	}
+
+	// Sign as the role the client asked for, if any
+	if roleSigner != nil {
+		req = req.WithContext(context.WithValue(req.Context(), signerKey{}, roleSigner))
+		signedAs = role
+	}
+
+	// Requests already signed by the client, e.g. by another proxy in
+	// front of this one, are forwarded with their own signature
+	passthrough := p.PassthroughSigned && copySignature(req, r)
+	if passthrough {
+		req = req.WithContext(context.WithValue(req.Context(), passthroughKey{}, true))
+	}
+
+	body := replaceBody(req)
+	signed := body
+
+	// Content-Type is always decided before signing, so the same request
+	// is signed with the same headers no matter how it was built
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		req.Header.Set("Content-Type", ct)
+	} else if len(body) > 0 && p.DefaultContentType != "" {
+		req.Header.Set("Content-Type", p.DefaultContentType)
+	}
+	if !passthrough && p.CompressMin > 0 && len(body) >= p.CompressMin {
+		signed = compressBody(req, body)
 	}
 
 	// Sign the request with AWSv4
-	payload := bytes.NewReader(replaceBody(req))
-	p.Signer.Sign(req, payload, p.Service, p.Region, time.Now())
+	if !passthrough {
+		payload := bytes.NewReader(signed)
+		p.signRequest(req, payload)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	if p.DebugHeaders {
+		w.Header().Set("X-Proxy-Signed-Path", req.URL.RequestURI())
+	}
+
+	if timeout := p.requestTimeout(r.Method, r.URL.Path); timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	// Each request holds an upstream connection until its response has been
+	// handled, fail fast rather than queue inside the transport
+	if p.UpstreamSlots != nil {
+		select {
+		case p.UpstreamSlots <- struct{}{}:
+			defer func() { <-p.UpstreamSlots }()
+		default:
+			log.Printf("Upstream connection limit of %d reached, rejecting %s\n", cap(p.UpstreamSlots), endpoint.RequestURI())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(fmt.Sprintf("All %d upstream connections are busy, please retry", cap(p.UpstreamSlots))))
+			return
+		}
+	}
+
+	upstreamStarted := p.now()
+	resp, err := p.do(req)
 	if err != nil {
+		// No response from upstream, so the status is up to the proxy
 		log.Println(err)
-		respondError(err)
+		status := http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+
+		// The write may still have reached ES
+		p.audit(r, body, status, requestStarted)
 		return
 	}
 
 	defer resp.Body.Close()
 
+	// Read at most one byte past the limit to tell if it was exceeded
+	var respBody io.Reader = resp.Body
+	if p.MaxResponseBytes > 0 {
+		respBody = io.LimitReader(resp.Body, p.MaxResponseBytes+1)
+	}
+	searchLimit := int64(0)
+	if p.MaxSearchResponseBytes > 0 && resp.StatusCode < 400 && p.SearchResponsePaths.MatchString(r.URL.Path) {
+		searchLimit = p.MaxSearchResponseBytes
+		respBody = io.LimitReader(respBody, searchLimit+1)
+	}
+
+	// Clients which ignore the response only get the status, the body is
+	// still drained so the connection can be reused. Errors are always
+	// passed on as ES sent them.
+	discard := resp.StatusCode < 400 && p.discardsBody(r.Method, r.URL.Path)
+	if discard {
+		respBody = bytes.NewReader(nil)
+		if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+			log.Printf("Failed draining upstream response for %s: %s\n", endpoint.RequestURI(), err)
+		}
+		resp.Header.Del("Content-Length")
+	}
+
+	// A body cut short must not look complete to the client, so the
+	// connection is dropped instead of answering with ES's status
+	buf := bytes.Buffer{}
+	if _, err := io.Copy(&buf, respBody); err != nil {
+		log.Printf("Failed reading upstream response for %s: %s\n", endpoint.RequestURI(), err)
+		p.audit(r, body, http.StatusBadGateway, requestStarted)
+		panic(http.ErrAbortHandler)
+	}
+	upstreamTook := p.now().Sub(upstreamStarted)
+
+	if p.MaxResponseBytes > 0 && int64(buf.Len()) > p.MaxResponseBytes {
+		log.Printf("Upstream response for %s exceeds %d bytes\n", endpoint.RequestURI(), p.MaxResponseBytes)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(fmt.Sprintf("Upstream response exceeds the proxy limit of %d bytes", p.MaxResponseBytes)))
+		p.audit(r, body, resp.StatusCode, requestStarted)
+		return
+	}
+
+	// Typically a terms aggregation with a huge size, which would only
+	// bring the client down
+	if searchLimit > 0 && int64(buf.Len()) > searchLimit {
+		log.Printf("Search response for %s exceeds %d bytes\n", endpoint.RequestURI(), searchLimit)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("Search response exceeds the proxy limit of %d bytes, narrow the query down, e.g. lower the size of aggregations or the number of hits", searchLimit)))
+		p.audit(r, body, resp.StatusCode, requestStarted)
+		return
+	}
+
+	if resp.StatusCode == http.StatusForbidden && signatureMismatch.Match(buf.Bytes()) {
+		log.Printf("Upstream rejected the request signature for %s: requests are signed for region %q and service %q, check that the endpoint's domain is in that region\n",
+			endpoint.RequestURI(), p.Region, p.Service)
+	}
+
+	if cacheKey != "" && !discard && resp.StatusCode == http.StatusOK {
+		p.MetaCache.set(cacheKey, resp.Header, buf.Bytes(), p.now())
+	}
+
 	// Write back received headers
 	copyHeaders(w.Header(), resp.Header)
+	if name, _ := p.clusterName.Load().(string); name != "" {
+		w.Header().Set("X-ES-Cluster-Name", name)
+	}
 
-	buf := bytes.Buffer{}
-	if _, err := io.Copy(&buf, resp.Body); err != nil {
-		log.Fatal(err)
+	// Durations are in milliseconds, added to any timings ES sent itself
+	if p.ServerTiming {
+		proxyTook := p.now().Sub(requestStarted) - upstreamTook
+		w.Header().Add("Server-Timing", fmt.Sprintf("upstream;dur=%.1f, proxy;dur=%.1f",
+			upstreamTook.Seconds()*1000, proxyTook.Seconds()*1000))
+	}
+
+	// Announce upstream trailers so they can be sent after the body
+	for k := range resp.Trailer {
+		w.Header().Add("Trailer", k)
 	}
 
 	// Send response back
 	w.WriteHeader(resp.StatusCode)
 	w.Write(buf.Bytes())
 
+	// Trailer values are only known once the upstream body has been read
+	copyHeaders(w.Header(), resp.Trailer)
+
+	p.audit(r, body, resp.StatusCode, requestStarted)
+
+	if p.Capture != nil {
+		rec := captureRecord{
+			Time:      requestStarted.UTC().Format(time.RFC3339Nano),
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			BodyBytes: len(body),
+		}
+		for _, name := range p.CaptureHeaders {
+			if v := r.Header.Get(name); v != "" {
+				if rec.Headers == nil {
+					rec.Headers = make(map[string]string)
+				}
+				rec.Headers[name] = p.redactCapture(v)
+			}
+		}
+		if len(body) <= p.CaptureMaxBody {
+			rec.Body = p.redactCapture(string(body))
+		} else {
+			rec.BodyOmitted = true
+		}
+		record, _ := json.Marshal(rec)
+		p.Capture.Println(string(record))
+	}
+
 	// Log everything
 	remoteAddr := r.RemoteAddr
 	rawQuery := string(dump)
@@ -151,30 +1830,106 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		query = ""
 	}
+	query = string(truncate([]byte(query), p.LogQueryMaxBytes))
 
-	if p.Verbose {
-		requestEnded := time.Since(requestStarted)
+	// Clients can ask for the bodies of their own request to be logged
+	if p.TraceBody && r.Header.Get("X-Debug") == "1" {
+		p.AccessLog.Printf("X-Debug %s %s -> %d\nRequest body:\n%s\nResponse body:\n%s\n",
+			r.Method, endpoint.RequestURI(), resp.StatusCode,
+			formatBody(r.Header.Get("Content-Type"), body, p.Indent),
+			formatBody(resp.Header.Get("Content-Type"), decodedBody(resp.Header, buf.Bytes()), p.Indent))
+	}
+
+	if !p.Verbose && p.Recent == nil && p.Slow == nil {
+		return
+	}
+
+	// Passed through requests carry the client's identity, which is unknown
+	var identity string
+	if p.Identity != nil && !passthrough {
+		identity = signedAs
+		if identity == "" {
+			_, identity = p.Identity.Get()
+		}
+	}
+	entry := logEntry{
+		Time:      requestStarted,
+		Method:    r.Method,
+		Path:      endpoint.RequestURI(),
+		Status:    resp.StatusCode,
+		Took:      p.now().Sub(requestStarted),
+		Remote:    remoteAddr,
+		Query:     query,
+		RequestID: r.Header.Get("X-Request-Id"),
+		Bytes:     buf.Len(),
+		Action:    classifyAction(r.Method, r.URL.Path),
+		Identity:  identity,
+		Upstream:  fmt.Sprintf("%s (%s)", p.Host, p.Region),
+	}
+	if p.LogSignedHeaders {
+		entry.SignedHeaders = signedHeaders(req.Header.Get("Authorization"))
+	}
+	if p.LogAuth {
+		entry.Auth = authAlgorithm(req.Header.Get("Authorization"))
+	}
+	if p.LogBody && !p.Prettify && dumpErr == nil {
+		entry.Body = singleLine(truncate(body, p.LogQueryMaxBytes))
+	}
+
+	if p.Recent != nil {
+		p.Recent.add(entry)
+	}
+
+	// The body is kept so the query can be replayed, up to a limit as the
+	// entries may stay around for the whole window
+	if p.Slow != nil && (entry.Action == "search" || entry.Action == "count") {
+		slow := entry
+		slow.Body = string(truncate(body, p.SlowlogMaxBody))
+		p.Slow.add(slow, p.now())
+	}
 
+	if p.Verbose {
 		if p.Prettify {
-			var prettyBody bytes.Buffer
-			json.Indent(&prettyBody, []byte(query), "", "  ")
-			t := time.Now()
-
-			fmt.Println()
-			fmt.Println("========================")
-			fmt.Println(t.Format("2006/01/02 15:04:05"))
-			fmt.Println("Remote Address: ", remoteAddr)
-			fmt.Println("Request URI: ", endpoint.RequestURI())
-			fmt.Println("Method: ", r.Method)
-			fmt.Println("Status: ", resp.StatusCode)
-			fmt.Printf("Took: %.3fs\n", requestEnded.Seconds())
-			fmt.Println("Body: ")
-			fmt.Println(string(prettyBody.Bytes()))
-			fmt.Println("========================")
+			t := p.now()
+
+			// Build the whole record first so it reaches the output in one write
+			var record bytes.Buffer
+			fmt.Fprintln(&record)
+			fmt.Fprintln(&record, "========================")
+			fmt.Fprintln(&record, t.Format("2006/01/02 15:04:05"))
+			fmt.Fprintln(&record, "Remote Address: ", entry.Remote)
+			fmt.Fprintln(&record, "Request URI: ", entry.Path)
+			fmt.Fprintln(&record, "Upstream: ", entry.Upstream)
+			fmt.Fprintln(&record, "Method: ", entry.Method)
+			fmt.Fprintln(&record, "Action: ", entry.Action)
+			if entry.Identity != "" {
+				fmt.Fprintln(&record, "Identity: ", entry.Identity)
+			}
+			if entry.SignedHeaders != "" {
+				fmt.Fprintln(&record, "Signed Headers: ", entry.SignedHeaders)
+			}
+			if entry.Auth != "" {
+				fmt.Fprintln(&record, "Authorization: ", entry.Auth)
+			}
+			fmt.Fprintln(&record, "Status: ", entry.Status)
+			fmt.Fprintf(&record, "Took: %.3fs\n", entry.Took.Seconds())
+			if p.LogBody {
+				fmt.Fprintln(&record, "Body: ")
+				if dumpErr == nil {
+					fmt.Fprintln(&record, formatBody(r.Header.Get("Content-Type"), truncate(body, p.LogQueryMaxBytes), p.Indent))
+				}
+			}
+			fmt.Fprintln(&record, "========================")
+			p.outputMu.Lock()
+			p.Output.Write(record.Bytes())
+			p.outputMu.Unlock()
 
 		} else {
-			log.Printf(" -> %s; %s; %s; %s; %d; %.3fs\n",
-				r.Method, remoteAddr, endpoint.RequestURI(), query, resp.StatusCode, requestEnded.Seconds())
+			var line bytes.Buffer
+			if err := p.LogTemplate.Execute(&line, entry); err != nil {
+				log.Println(err)
+			}
+			p.AccessLog.Println(line.String())
 		}
 	}
 }
@@ -183,31 +1938,542 @@ func main() {
 	var endpoint, listenAddress string
 	var verbose bool
 	var prettify bool
+	var allowedMethods stringSlice
+	var logBuffer bool
+	var userAgent string
+	var signHeaders stringSlice
+	var pprofListen string
+	var ecsCreds bool
+	var tlsServerName string
+	var failClosed bool
+	var logSyslog bool
+	var syslogAddress, syslogFacility, syslogTag string
+	var showVersion bool
+	var forwardOptions bool
+	var maxHeaderBytes int
+	var auditLog string
+	var metaCacheTTL time.Duration
+	var upstreamAccept string
+	var followRedirects bool
+	var maxURILength int
+	var region, service string
+	var maxConnsPerIP int
+	var logTemplate string
+	var compressUpstream bool
+	var compressMinBytes int
+	var resolve stringSlice
+	var logIdentity bool
+	var methodOverrides stringSlice
+	var recentBuffer int
+	var passthroughSigned bool
+	var maxResponseBytes int64
+	var unsignedPayload bool
+	var disableClientKeepalive bool
+	var logSignedHeaders bool
+	var requireIndex bool
+	var forwardClientIP bool
+	var upstreamIdleConnTimeout time.Duration
+	var upstreamDisableKeepalive bool
+	var maintenance bool
+	var maintenanceMessage string
+	var maintenanceRetryAfter time.Duration
+	var drainDelay time.Duration
+	var roleHeader string
+	var allowedRoles stringSlice
+	var otlpEndpoint string
+	var logQueryMaxBytes int
+	var upstreamHTTP2 bool
+	var debugHeaders bool
+	var noKbnWorkaround bool
+	var accessLogOutput, logOutputName string
+	var readyStatuses string
+	var credSource string
+	var discardBodyFor stringSlice
+	var maxCredAge time.Duration
+	var serverTiming bool
+	var searchTimeout, writeTimeout time.Duration
+	var caCerts stringSlice
+	var defaultContentType string
+	var authzHookURL string
+	var authzHeaders stringSlice
+	var authzCacheTTL time.Duration
+	var logBody bool
+	var slowlogSize int
+	var defaultIndex string
+	var traceBody bool
+	var upstreamNoDelay bool
+	var upstreamKeepalive time.Duration
+	var maxSearchResponseBytes int64
+	var searchResponsePaths string
+	var profile, sharedCredentialsFile string
+	var logAuth bool
+	var readRole, writeRole string
+	var allowAnyService bool
+	var captureFile string
+	var captureHeaders stringSlice
+	var captureMaxBody int
+	var captureRedact stringSlice
+	var maxUpstreamConns int
+	var indent string
+	var clusterNameHeader bool
+	var clusterNameRefresh time.Duration
+	var maxIndicesPerRequest int
+	var indexListRefresh time.Duration
+	var slowlogWindow time.Duration
+	var slowlogMaxBody int
 
 	// TODO: Use a more sophisticated args parser that can enforce arguments
 	flag.StringVar(&endpoint, "endpoint", "", "Amazon ElasticSearch Endpoint (e.g: https://dummy-host.eu-west-1.es.amazonaws.com)")
 	flag.StringVar(&listenAddress, "listen", "127.0.0.1:9200", "Local TCP port to listen on")
 	flag.BoolVar(&verbose, "verbose", false, "Print user requests")
 	flag.BoolVar(&prettify, "pretty", false, "Prettify verbose output")
+	flag.BoolVar(&logBuffer, "log-buffer", false, "Buffer verbose output and flush it every second (for high request rates)")
+	flag.StringVar(&userAgent, "user-agent", "aws-es-proxy/"+version, "User-Agent sent on upstream requests")
+	flag.BoolVar(&ecsCreds, "ecs-creds", false, "Use the ECS container credentials endpoint instead of the default credentials chain (same as -cred-source ecs)")
+	flag.StringVar(&tlsServerName, "tls-server-name", "", "Server name (SNI) to present and verify in the upstream TLS handshake (default endpoint host)")
+	flag.BoolVar(&failClosed, "fail-closed", false, "Reject requests with 503 while AWS credentials are unavailable")
+	flag.StringVar(&pprofListen, "pprof-listen", "", "Local TCP address to serve net/http/pprof profiles on (disabled by default)")
+	flag.Var(&signHeaders, "sign-header", "Header to include in the AWSv4 signature, can be repeated (default all)")
+	flag.Var(&allowedMethods, "allow-method", "HTTP method allowed to pass through, can be repeated (default all)")
+	flag.BoolVar(&logSyslog, "log-syslog", false, "Send verbose output to syslog instead of stdout/stderr")
+	flag.StringVar(&syslogAddress, "syslog-address", "", "Remote syslog address (e.g: udp://logs.example.com:514, default local syslog)")
+	flag.StringVar(&syslogFacility, "syslog-facility", "user", "Syslog facility (e.g: user, daemon, local0)")
+	flag.StringVar(&syslogTag, "syslog-tag", "aws-es-proxy", "Syslog tag")
+	flag.BoolVar(&showVersion, "version", false, "Print version information and exit")
+	flag.BoolVar(&forwardOptions, "forward-options", false, "Sign and forward OPTIONS requests instead of answering them locally")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size in bytes of client request headers")
+	flag.StringVar(&auditLog, "audit-log", "", "File to record every write request to, one JSON object per line")
+	flag.DurationVar(&metaCacheTTL, "meta-cache-ttl", 0, "Cache cluster health, mapping and _cat/indices responses for this long (e.g: 5s, disabled by default)")
+	flag.StringVar(&upstreamAccept, "upstream-accept", "", "Accept header sent on upstream requests (e.g: application/smile)")
+	flag.BoolVar(&followRedirects, "follow-redirects", false, "Follow and re-sign upstream redirects to the endpoint host instead of returning them to the client")
+	flag.IntVar(&maxURILength, "max-uri-length", 0, "Reject requests whose path and query exceed this many bytes with 414 (default unlimited)")
+	flag.StringVar(&region, "region", "", "AWS region to sign requests for (default taken from endpoint)")
+	flag.StringVar(&service, "service", "", "AWS service name to sign requests for (default taken from endpoint, e.g: es, aoss)")
+	flag.IntVar(&maxConnsPerIP, "max-conns-per-ip", 0, "Reset new connections from a client IP which already has this many open (default unlimited)")
+	flag.StringVar(&logTemplate, "log-template", defaultLogTemplate, "Go text/template for verbose output lines, with fields Time, Method, Path, Status, Took, Remote, Query, RequestID, Bytes, Action, Identity, SignedHeaders, Auth, Upstream and Body")
+	flag.BoolVar(&compressUpstream, "compress-upstream", false, "Gzip request bodies sent to the endpoint, which must accept gzip encoded requests")
+	flag.IntVar(&compressMinBytes, "compress-min-bytes", 1024, "Only gzip request bodies of at least this many bytes")
+	flag.Var(&resolve, "resolve", "Connect to the given IP for a host name instead of resolving it (host:ip), can be repeated")
+	flag.BoolVar(&logIdentity, "log-identity", false, "Include the IAM identity requests are signed as in verbose output")
+	flag.Var(&methodOverrides, "method-override", "HTTP method clients may switch to with X-HTTP-Method-Override, can be repeated (default none)")
+	flag.IntVar(&recentBuffer, "recent-buffer", 0, "Keep this many recent requests in memory and serve them at GET /_recent (disabled by default)")
+	flag.BoolVar(&passthroughSigned, "passthrough-signed", false, "Forward requests already carrying an AWSv4 signature as they are instead of signing them again")
+	flag.Int64Var(&maxResponseBytes, "max-response-bytes", 0, "Answer with 502 instead of forwarding upstream responses larger than this many bytes (default unlimited)")
+	flag.BoolVar(&unsignedPayload, "unsigned-payload", false, "Sign requests with an UNSIGNED-PAYLOAD content hash instead of hashing the body (the endpoint must accept it)")
+	flag.BoolVar(&disableClientKeepalive, "disable-client-keepalive", false, "Close client connections after every response")
+	flag.BoolVar(&logSignedHeaders, "log-signed-headers", false, "Include the names of signed headers in verbose output")
+	flag.BoolVar(&requireIndex, "require-index", false, "Reject search, count and msearch requests which don't name an index in their path")
+	flag.BoolVar(&forwardClientIP, "forward-client-ip", false, "Append the client IP to the X-Forwarded-For header sent upstream")
+	flag.DurationVar(&upstreamIdleConnTimeout, "upstream-idle-conn-timeout", 90*time.Second, "Close idle upstream connections after this long, keep it below the upstream's own idle timeout")
+	flag.BoolVar(&upstreamDisableKeepalive, "upstream-disable-keepalive", false, "Open a new upstream connection for every request")
+	flag.BoolVar(&maintenance, "maintenance", false, "Start in maintenance mode, answering all requests with 503 (toggle with SIGHUP)")
+	flag.StringVar(&maintenanceMessage, "maintenance-message", "Elasticsearch is under maintenance, please try again later", "Response body sent in maintenance mode")
+	flag.DurationVar(&maintenanceRetryAfter, "maintenance-retry-after", 5*time.Minute, "Retry-After sent in maintenance mode (0 to omit)")
+	flag.DurationVar(&drainDelay, "drain-delay", 0, "How long /_ready answers 503 after SIGTERM before the proxy stops accepting requests")
+	flag.StringVar(&roleHeader, "role-header", "", "Request header naming an IAM role ARN to assume for signing that request (e.g: X-AWS-Role-Arn)")
+	flag.Var(&allowedRoles, "allow-role", "IAM role ARN clients may select with -role-header, can be repeated")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint to export request traces to (e.g: http://localhost:4318, requires building with -tags otel)")
+	flag.IntVar(&logQueryMaxBytes, "log-query-max-bytes", 0, "Truncate request bodies in verbose output to this many bytes (default unlimited)")
+	flag.BoolVar(&upstreamHTTP2, "upstream-http2", false, "Negotiate HTTP/2 with the endpoint instead of using HTTP/1.1")
+	flag.BoolVar(&debugHeaders, "debug-headers", false, "Add the signed and forwarded path to responses in an X-Proxy-Signed-Path header")
+	flag.BoolVar(&noKbnWorkaround, "no-kbn-workaround", false, "Don't forward Kibana and OpenSearch Dashboards version and XSRF headers")
+	flag.StringVar(&accessLogOutput, "access-log-output", "stdout", "Stream verbose output is written to (stdout or stderr)")
+	flag.StringVar(&logOutputName, "log-output", "stderr", "Stream the proxy's own messages and errors are written to (stdout or stderr)")
+	flag.StringVar(&readyStatuses, "ready-statuses", "green,yellow", "Comma separated cluster health statuses for which GET /_ready answers 200 instead of 503")
+	flag.StringVar(&credSource, "cred-source", "", "Only take credentials from this source instead of the default chain (env, profile, ec2, ecs or web-identity)")
+	flag.Var(&discardBodyFor, "discard-body-for", "Drain the upstream response and send only the status and headers for requests matching METHOD:path-regexp, e.g. POST:/_bulk$ (* matches any method), can be repeated")
+	flag.DurationVar(&maxCredAge, "max-cred-age", 0, "Fetch credentials again once they are this old, even if they have not expired yet (default only on expiry)")
+	flag.BoolVar(&serverTiming, "server-timing", false, "Report time spent upstream and in the proxy in a Server-Timing response header")
+	flag.DurationVar(&searchTimeout, "search-timeout", 0, "Give up on search and count requests taking longer than this (default no limit)")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "Give up on requests modifying data taking longer than this (default no limit)")
+	flag.Var(&caCerts, "ca-cert", "PEM file with CA certificates to trust for the endpoint in addition to the system ones, can be repeated")
+	flag.StringVar(&defaultContentType, "default-content-type", "application/json", "Content-Type sent upstream for requests with a body when the client didn't set one (empty to send none)")
+	flag.StringVar(&authzHookURL, "authz-hook", "", "URL to POST request metadata to before forwarding, only requests it answers with 200 are let through")
+	flag.Var(&authzHeaders, "authz-header", "Request header to include in calls to -authz-hook, can be repeated")
+	flag.DurationVar(&authzCacheTTL, "authz-cache-ttl", 5*time.Second, "How long -authz-hook decisions are reused for identical requests")
+	flag.BoolVar(&logBody, "log-body", false, "Include request bodies in verbose output, on a single line unless -pretty is set (default true with -pretty)")
+	flag.IntVar(&slowlogSize, "slowlog-size", 0, "Keep this many of the slowest recent search and count requests, with their bodies, and serve them at GET /_slowlog (disabled by default)")
+	flag.StringVar(&defaultIndex, "default-index", "", "Index to send search and count requests to when their path doesn't name one")
+	flag.BoolVar(&traceBody, "trace-body", false, "Log request and response bodies of requests sent with an X-Debug: 1 header, even without -verbose")
+	flag.BoolVar(&upstreamNoDelay, "upstream-nodelay", true, "Set TCP_NODELAY on upstream connections, -upstream-nodelay=false lets small writes be coalesced")
+	flag.DurationVar(&upstreamKeepalive, "upstream-keepalive", 30*time.Second, "Interval of TCP keep-alive probes on upstream connections (negative to disable)")
+	flag.Int64Var(&maxSearchResponseBytes, "max-search-response-bytes", 0, "Answer with 413 instead of forwarding successful responses larger than this many bytes to requests matching -search-response-paths (default unlimited)")
+	flag.StringVar(&searchResponsePaths, "search-response-paths", `/_m?search(/|$)`, "Regular expression for the request paths -max-search-response-bytes applies to")
+	flag.StringVar(&profile, "profile", "", "Shared credentials profile to use (default $AWS_PROFILE or default)")
+	flag.StringVar(&sharedCredentialsFile, "shared-credentials-file", "", "Read shared credentials and config from this file instead of ~/.aws/credentials and ~/.aws/config")
+	flag.BoolVar(&logAuth, "log-auth", false, "Include the algorithm of the Authorization header sent upstream, or none, in verbose output (never the signature)")
+	flag.StringVar(&readRole, "read-role", "", "IAM role ARN to assume for signing requests which don't modify data (default the proxy's own credentials)")
+	flag.StringVar(&writeRole, "write-role", "", "IAM role ARN to assume for signing requests which modify data (default the proxy's own credentials)")
+	flag.BoolVar(&allowAnyService, "allow-any-service", false, "Sign for a -service other than es or aoss")
+	flag.StringVar(&captureFile, "capture-file", "", "File to record every proxied request to for replay, one JSON object per line")
+	flag.Var(&captureHeaders, "capture-header", "Request header to record in -capture-file besides Content-Type, can be repeated")
+	flag.IntVar(&captureMaxBody, "capture-max-body", 64*1024, "Leave request bodies larger than this many bytes out of -capture-file")
+	flag.Var(&captureRedact, "capture-redact", "Regular expression whose matches are masked in -capture-file bodies and headers, e.g. \"password\":\"[^\"]*\", can be repeated")
+	flag.IntVar(&maxUpstreamConns, "max-upstream-conns", 0, "Answer with 503 instead of waiting when this many requests are already in flight upstream (default unlimited)")
+	flag.StringVar(&indent, "indent", "2", "Indentation of JSON bodies in prettified output, a number of spaces or tab")
+	flag.BoolVar(&clusterNameHeader, "cluster-name-header", false, "Name the cluster that answered in an X-ES-Cluster-Name response header")
+	flag.DurationVar(&clusterNameRefresh, "cluster-name-refresh", 5*time.Minute, "How often to look up the cluster name for -cluster-name-header")
+	flag.IntVar(&maxIndicesPerRequest, "max-indices-per-request", 0, "Reject requests whose index pattern matches more than this many indices with 400 (default unlimited)")
+	flag.DurationVar(&indexListRefresh, "index-list-refresh", time.Minute, "How often to refresh the index list used by -max-indices-per-request")
+	flag.DurationVar(&slowlogWindow, "slowlog-window", 15*time.Minute, "How long requests are kept in GET /_slowlog")
+	flag.IntVar(&slowlogMaxBody, "slowlog-max-body", 64*1024, "Truncate request bodies kept in GET /_slowlog to this many bytes")
 
 	flag.Parse()
 
-	if len(os.Args) < 3 {
-		fmt.Println("You need to specify Amazon ElasticSearch endpoint.")
-		fmt.Println("Please run with '-h' for a list of available arguments.")
+	// -pretty used to always print bodies, keep that unless told otherwise
+	if prettify {
+		logBody = true
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "log-body" {
+				logBody = f.Value.String() == "true"
+			}
+		})
+	}
+
+	if showVersion || flag.Arg(0) == "version" {
+		fmt.Printf("aws-es-proxy %s (commit %s, built %s)\n", version, commit, buildDate)
+		os.Exit(0)
+	}
+
+	if endpoint == "" {
+		fmt.Fprintln(os.Stderr, "You need to specify Amazon ElasticSearch endpoint.")
+		flag.Usage()
 		os.Exit(1)
 	}
 
+	// Access logs and the proxy's own messages go to separately chosen streams
+	streams := map[string]io.Writer{"stdout": os.Stdout, "stderr": os.Stderr}
+	accessOutput, ok := streams[accessLogOutput]
+	if !ok {
+		log.Fatalf("ERROR: Unknown access log output %q, use stdout or stderr\n", accessLogOutput)
+	}
+	logOutput, ok := streams[logOutputName]
+	if !ok {
+		log.Fatalf("ERROR: Unknown log output %q, use stdout or stderr\n", logOutputName)
+	}
+	log.SetOutput(logOutput)
+
+	if err := setupTracing(otlpEndpoint); err != nil {
+		log.Fatalf("ERROR: Failed setting up tracing: %s\n", err)
+	}
+
 	// Start AWS session from ENV, Shared Creds or EC2Role
-	sess, err := session.NewSession()
+	opts := session.Options{Profile: profile}
+	if sharedCredentialsFile != "" {
+		opts.SharedConfigFiles = []string{sharedCredentialsFile}
+	}
+	sess, err := session.NewSessionWithOptions(opts)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	signer := v4.NewSigner(sess.Config.Credentials)
+	if ecsCreds {
+		credSource = "ecs"
+	}
+	creds := sess.Config.Credentials
+	if credSource != "" {
+		creds = sourceCredentials(sess, credSource, sharedCredentialsFile, profile)
+	}
+	var signerOptions []func(*v4.Signer)
+	if unsignedPayload {
+		signerOptions = append(signerOptions, v4.WithUnsignedPayload)
+	}
+	signer := v4.NewSigner(creds, signerOptions...)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsServerName != "" || len(caCerts) > 0 {
+		transport.TLSClientConfig = &tls.Config{ServerName: tlsServerName}
+	}
+	if len(caCerts) > 0 {
+		transport.TLSClientConfig.RootCAs = certPool(caCerts)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: upstreamKeepalive}
+	dial := dialFunc(dialer.DialContext)
+	if len(resolve) > 0 {
+		dial = resolvingDialer(resolve, dial)
+	}
+	if !upstreamNoDelay {
+		dial = delayingDialer(dial)
+	}
+	transport.DialContext = dial
+	transport.IdleConnTimeout = upstreamIdleConnTimeout
+
+	// A non-nil, empty TLSNextProto keeps the transport from negotiating h2
+	transport.ForceAttemptHTTP2 = upstreamHTTP2
+	if !upstreamHTTP2 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	transport.DisableKeepAlives = upstreamDisableKeepalive
+	transport.MaxConnsPerHost = maxUpstreamConns
+
+	tmpl, err := template.New("log").Parse(logTemplate)
+	if err != nil {
+		log.Fatalf("ERROR: Failed parsing log template: %s\n", err)
+	}
+
+	var redact []*regexp.Regexp
+	for _, expr := range captureRedact {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("ERROR: Invalid -capture-redact: %s\n", err)
+		}
+		redact = append(redact, re)
+	}
 
-	mux := &proxy{Verbose: verbose, Prettify: prettify, Signer: signer}
+	var statuses []string
+	for _, status := range strings.Split(readyStatuses, ",") {
+		if status = strings.TrimSpace(status); status != "" {
+			statuses = append(statuses, status)
+		}
+	}
+
+	searchPaths, err := regexp.Compile(searchResponsePaths)
+	if err != nil {
+		log.Fatalf("ERROR: Invalid -search-response-paths: %s\n", err)
+	}
+
+	// Log records are written unbuffered by default so they show up
+	// immediately, e.g. in `docker logs`
+	accessFlags := log.LstdFlags
+	if logSyslog {
+		w, err := newSyslogWriter(syslogAddress, syslogFacility, syslogTag)
+		if err != nil {
+			log.Fatalf("ERROR: Failed setting up syslog: %s\n", err)
+		}
+		// syslog timestamps records itself, and buffering would merge
+		// several records into one message
+		accessOutput, accessFlags = w, 0
+	} else if logBuffer {
+		accessOutput = newBufferedWriter(accessOutput, time.Second)
+	}
+
+	mux := &proxy{
+		Region:                 region,
+		Service:                service,
+		Verbose:                verbose,
+		Prettify:               prettify,
+		AllowedMethods:         allowedMethods,
+		ForwardOptions:         forwardOptions,
+		MethodOverrides:        methodOverrides,
+		MaxURILength:           maxURILength,
+		UserAgent:              userAgent,
+		UpstreamAccept:         upstreamAccept,
+		SignHeaders:            signHeaders,
+		FailClosed:             failClosed,
+		Credentials:            creds,
+		Signer:                 signer,
+		Client:                 &http.Client{Transport: transport},
+		FollowRedirects:        followRedirects,
+		PassthroughSigned:      passthroughSigned,
+		Output:                 accessOutput,
+		AccessLog:              log.New(accessOutput, "", accessFlags),
+		Clock:                  time.Now,
+		LogTemplate:            tmpl,
+		MaxResponseBytes:       maxResponseBytes,
+		LogSignedHeaders:       logSignedHeaders,
+		RequireIndex:           requireIndex,
+		ForwardClientIP:        forwardClientIP,
+		MaintenanceMessage:     maintenanceMessage,
+		MaintenanceRetryAfter:  maintenanceRetryAfter,
+		RoleHeader:             roleHeader,
+		LogQueryMaxBytes:       logQueryMaxBytes,
+		DebugHeaders:           debugHeaders,
+		KbnWorkaround:          !noKbnWorkaround,
+		ReadyStatuses:          statuses,
+		DiscardBody:            parseDiscardRules(discardBodyFor),
+		ServerTiming:           serverTiming,
+		SearchTimeout:          searchTimeout,
+		WriteTimeout:           writeTimeout,
+		DefaultContentType:     defaultContentType,
+		LogBody:                logBody,
+		DefaultIndex:           defaultIndex,
+		TraceBody:              traceBody,
+		MaxSearchResponseBytes: maxSearchResponseBytes,
+		SearchResponsePaths:    searchPaths,
+		LogAuth:                logAuth,
+		ReadRole:               readRole,
+		WriteRole:              writeRole,
+		CaptureHeaders:         append([]string{"Content-Type"}, captureHeaders...),
+		CaptureMaxBody:         captureMaxBody,
+		CaptureRedact:          redact,
+		Indent:                 parseIndent(indent),
+		MaxIndicesPerRequest:   maxIndicesPerRequest,
+		SlowlogMaxBody:         slowlogMaxBody,
+	}
 	parseEndpoint(endpoint, mux)
 
-	fmt.Printf("Listening on %s\n", listenAddress)
-	log.Fatal(http.ListenAndServe(listenAddress, mux))
+	// Signing for another service works, but ES rejects every request
+	if !allowAnyService && !knownServices[mux.Service] {
+		log.Fatalf("ERROR: Unknown signing service %q, set -service to es or aoss, or use -allow-any-service to sign for it anyway\n", mux.Service)
+	}
+	mux.Client.CheckRedirect = mux.checkRedirect
+
+	// SIGHUP toggles maintenance mode
+	mux.setMaintenance(maintenance)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			on := !mux.inMaintenance()
+			mux.setMaintenance(on)
+			log.Printf("Maintenance mode: %t\n", on)
+		}
+	}()
+
+	// Fetch credentials up front so the first request doesn't pay for it
+	if err := mux.credentialsAvailable(); err != nil {
+		if failClosed {
+			log.Fatalf("ERROR: Failed fetching AWS credentials: %s\n", err)
+		}
+		log.Printf("WARNING: Failed fetching AWS credentials, retrying on first request: %s\n", err)
+	}
+
+	// STS may be out of reach, e.g. from a VPC without an STS endpoint,
+	// which mustn't hold up startup
+	identity := newCallerIdentity(sess, creds, mux.Region)
+	go func() {
+		if account, arn := identity.Get(); arn != "" {
+			fmt.Printf("Signing requests as %s (account %s)\n", arn, account)
+		}
+	}()
+	if logIdentity {
+		mux.Identity = identity
+	}
+
+	if roleHeader != "" {
+		stsSess := sess.Copy(&aws.Config{Region: aws.String(mux.Region)})
+		mux.Roles = newRoleSigners(stsSess, allowedRoles, signerOptions)
+	}
+
+	if readRole != "" || writeRole != "" {
+		stsSess := sess.Copy(&aws.Config{Region: aws.String(mux.Region)})
+		mux.OperationRoles = newRoleSigners(stsSess, []string{readRole, writeRole}, signerOptions)
+	}
+
+	// Expiring the cached credentials, the proxy's own and those of every
+	// assumed role, makes the next request fetch new ones
+	if maxCredAge > 0 {
+		go func() {
+			for range time.Tick(maxCredAge) {
+				creds.Expire()
+				mux.Roles.expire()
+				mux.OperationRoles.expire()
+			}
+		}()
+	}
+
+	if recentBuffer > 0 {
+		mux.Recent = newRecentLog(recentBuffer)
+	}
+
+	if slowlogSize > 0 {
+		mux.Slow = newSlowLog(slowlogSize, slowlogWindow)
+	}
+
+	if compressUpstream {
+		mux.CompressMin = compressMinBytes
+		if mux.CompressMin < 1 {
+			mux.CompressMin = 1
+		}
+	}
+
+	if metaCacheTTL > 0 {
+		mux.MetaCache = newMetaCache(metaCacheTTL)
+	}
+
+	if authzHookURL != "" {
+		mux.Authz = newAuthzHook(authzHookURL, authzHeaders, authzCacheTTL)
+	}
+
+	if auditLog != "" {
+		f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("ERROR: Failed opening audit log: %s\n", err)
+		}
+		mux.AuditLog = log.New(f, "", 0)
+	}
+
+	if clusterNameHeader {
+		go func() {
+			mux.refreshClusterName()
+			for range time.Tick(clusterNameRefresh) {
+				mux.refreshClusterName()
+			}
+		}()
+	}
+
+	if maxIndicesPerRequest > 0 {
+		go func() {
+			mux.refreshIndices()
+			for range time.Tick(indexListRefresh) {
+				mux.refreshIndices()
+			}
+		}()
+	}
+
+	if maxUpstreamConns > 0 {
+		mux.UpstreamSlots = make(chan struct{}, maxUpstreamConns)
+	}
+
+	if captureFile != "" {
+		f, err := os.OpenFile(captureFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("ERROR: Failed opening capture file: %s\n", err)
+		}
+		mux.Capture = log.New(f, "", 0)
+	}
+
+	// pprof registers its handlers on the default mux, which the proxy
+	// itself never serves
+	if pprofListen != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(pprofListen, nil))
+		}()
+		fmt.Printf("Serving pprof on %s\n", pprofListen)
+	}
+
+	server := &http.Server{
+		Addr:           listenAddress,
+		Handler:        mux,
+		MaxHeaderBytes: maxHeaderBytes,
+	}
+	if disableClientKeepalive {
+		server.SetKeepAlivesEnabled(false)
+	}
+
+	// Prefer a socket handed over by systemd to binding -listen
+	ln, err := systemdListener()
+	if err != nil {
+		log.Fatalf("ERROR: Failed using systemd socket: %s\n", err)
+	}
+	if ln == nil {
+		ln, err = net.Listen("tcp", listenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("Listening on %s\n", ln.Addr())
+	if maxConnsPerIP > 0 {
+		ln = newPerIPListener(ln, maxConnsPerIP)
+	}
+
+	// SIGTERM first fails /_ready so load balancers stop sending requests,
+	// then waits for the ones in flight to finish
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-term
+		mux.startDraining()
+		log.Printf("Draining for %s before shutting down\n", drainDelay)
+		time.Sleep(drainDelay)
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Failed shutting down: %s\n", err)
+		}
+		close(stopped)
+	}()
+
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
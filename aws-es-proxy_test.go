@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+var testCredentials = credentials.NewStaticCredentials("AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "")
+
+// newTestProxy returns a proxy signing for upstream with testCredentials
+func newTestProxy(t *testing.T, upstream *httptest.Server) *proxy {
+	t.Helper()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &proxy{
+		Scheme:      u.Scheme,
+		Host:        u.Host,
+		Region:      "us-east-1",
+		Service:     "es",
+		Credentials: testCredentials,
+		Signer:      v4.NewSigner(testCredentials),
+		Client:      upstream.Client(),
+	}
+}
+
+// checkSignature signs the request the upstream received once more, over
+// the headers it claims to have signed and the body it got, and compares
+// the signatures. An empty body has to be signed with the hash of the
+// empty string.
+func checkSignature(t *testing.T, r *http.Request, body []byte) {
+	t.Helper()
+	auth := r.Header.Get("Authorization")
+	signed, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		t.Errorf("no valid X-Amz-Date: %s", err)
+		return
+	}
+
+	req, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for _, name := range strings.Split(signedHeaders(auth), ";") {
+		if name != "host" {
+			req.Header[http.CanonicalHeaderKey(name)] = r.Header[http.CanonicalHeaderKey(name)]
+		}
+	}
+	v4.NewSigner(testCredentials).Sign(req, bytes.NewReader(body), "es", "us-east-1", signed)
+	if want := req.Header.Get("Authorization"); auth != want {
+		t.Errorf("Authorization = %q, want %q", auth, want)
+	}
+}
+
+// received is what the upstream got for a single request
+type received struct {
+	req  *http.Request
+	body []byte
+}
+
+// recordingUpstream answers every request with status and body, and sends
+// what it received on the returned channel
+func recordingUpstream(t *testing.T, status int, body string) (*httptest.Server, <-chan received) {
+	ch := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		checkSignature(t, r, b)
+		ch <- received{req: r, body: b}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, ch
+}
+
+func TestReplaceBodyEmpty(t *testing.T) {
+	for name, body := range map[string]*bytes.Reader{"nil": nil, "empty": bytes.NewReader(nil)} {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://localhost/_search", nil)
+			if body != nil {
+				req.Body = ioutil.NopCloser(body)
+				req.ContentLength = -1
+			}
+
+			if payload := replaceBody(req); len(payload) != 0 {
+				t.Errorf("payload = %q, want empty", payload)
+			}
+			if req.Body != nil {
+				t.Error("Body is not nil")
+			}
+			if req.ContentLength != 0 {
+				t.Errorf("ContentLength = %d, want 0", req.ContentLength)
+			}
+		})
+	}
+}
+
+func TestServeHTTPEmptyGet(t *testing.T) {
+	for name, body := range map[string]func() *http.Request{
+		"nil": func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/_search", nil)
+		},
+		"empty": func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/_search", strings.NewReader(""))
+			r.ContentLength = -1
+			return r
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			upstream, got := recordingUpstream(t, http.StatusOK, `{}`)
+			p := newTestProxy(t, upstream)
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, body())
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", w.Code)
+			}
+
+			r := <-got
+			if r.req.ContentLength != 0 || len(r.req.TransferEncoding) > 0 {
+				t.Errorf("upstream got Content-Length %d and Transfer-Encoding %v, want 0 and none",
+					r.req.ContentLength, r.req.TransferEncoding)
+			}
+			if len(r.body) != 0 {
+				t.Errorf("upstream got body %q, want none", r.body)
+			}
+		})
+	}
+}
+
+func TestECSCredentials(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var calls int
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/v2/credentials/task" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"AccessKeyId":"AKIDTASK","SecretAccessKey":"secret","Token":"token","Expiration":%q}`,
+			expiration.Format(time.RFC3339))
+	}))
+	defer metadata.Close()
+
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/task")
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	creds, err := ecsCredentials(sess, metadata.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "AKIDTASK" || v.SecretAccessKey != "secret" || v.SessionToken != "token" {
+		t.Errorf("got credentials %+v from the container endpoint", v)
+	}
+
+	// Refreshed five minutes ahead of the expiry the endpoint reported
+	expires, err := creds.ExpiresAt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := expiration.Add(-5 * time.Minute); !expires.Equal(want) {
+		t.Errorf("credentials expire at %s, want %s", expires, want)
+	}
+
+	creds.Get()
+	if calls != 1 {
+		t.Errorf("container endpoint called %d times, want 1 while the credentials are valid", calls)
+	}
+}
+
+func TestECSCredentialsOutsideECS(t *testing.T) {
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	if _, err := ecsCredentials(sess, "http://127.0.0.1:1"); err == nil {
+		t.Error("no error without AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	}
+}
+
+func TestServeHTTPUpstreamStatus(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusConflict, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			body := fmt.Sprintf(`{"error":{"type":"test_exception"},"status":%d}`, status)
+			upstream, _ := recordingUpstream(t, status, body)
+			p := newTestProxy(t, upstream)
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/index/_doc/1", strings.NewReader(`{"a":1}`)))
+			if w.Code != status {
+				t.Errorf("status = %d, want %d", w.Code, status)
+			}
+			if w.Body.String() != body {
+				t.Errorf("body = %q, want %q", w.Body.String(), body)
+			}
+		})
+	}
+}
+
+func TestServeHTTPContentType(t *testing.T) {
+	for name, tc := range map[string]struct{ sent, want string }{
+		"client content type":  {sent: "application/x-ndjson", want: "application/x-ndjson"},
+		"default content type": {sent: "", want: "application/json"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			upstream, got := recordingUpstream(t, http.StatusOK, `{}`)
+			p := newTestProxy(t, upstream)
+			p.DefaultContentType = "application/json"
+
+			r := httptest.NewRequest(http.MethodPost, "/index/_search", strings.NewReader(`{"query":{"match_all":{}}}`))
+			if tc.sent != "" {
+				r.Header.Set("Content-Type", tc.sent)
+			}
+			p.ServeHTTP(httptest.NewRecorder(), r)
+
+			// checkSignature has verified the signature over it already
+			received := <-got
+			if ct := received.req.Header.Get("Content-Type"); ct != tc.want {
+				t.Errorf("upstream got Content-Type %q, want %q", ct, tc.want)
+			}
+			signed := signedHeaders(received.req.Header.Get("Authorization"))
+			if signed != "content-type;host;x-amz-date" {
+				t.Errorf("signed headers are %q, want content-type;host;x-amz-date", signed)
+			}
+		})
+	}
+}
+
+func TestServeHTTPErrorBodyUnchanged(t *testing.T) {
+	const body = "{\n  \"error\" : {\n    \"type\" : \"parsing_exception\",\n    \"reason\" : \"Unknown key for a START_OBJECT in [quer].\"\n  },\n  \"status\" : 400\n}\n"
+	for name, verbose := range map[string]bool{"quiet": false, "verbose": true} {
+		t.Run(name, func(t *testing.T) {
+			upstream, _ := recordingUpstream(t, http.StatusBadRequest, body)
+			p := newTestProxy(t, upstream)
+			if verbose {
+				p.Verbose, p.Prettify, p.LogBody, p.TraceBody = true, true, true, true
+				p.Output = ioutil.Discard
+				p.AccessLog = log.New(ioutil.Discard, "", 0)
+				p.LogTemplate = template.Must(template.New("log").Parse(defaultLogTemplate))
+				p.Indent = "  "
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/index/_search", strings.NewReader(`{"quer":{}}`))
+			r.Header.Set("X-Debug", "1")
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+			if w.Body.String() != body {
+				t.Errorf("body = %q, want %q", w.Body.String(), body)
+			}
+		})
+	}
+}
+
+func BenchmarkCopyHeaders(b *testing.B) {
+	src := http.Header{}
+	for i := 0; i < 200; i++ {
+		src.Add(fmt.Sprintf("X-Custom-%d", i), "value")
+		src.Add("Set-Cookie", fmt.Sprintf("cookie%d=value", i))
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copyHeaders(http.Header{}, src)
+	}
+}
+
+func TestServeHTTPGetBody(t *testing.T) {
+	const query = `{"query":{"term":{"user":"kimchy"}}}`
+	upstream, got := recordingUpstream(t, http.StatusOK, `{}`)
+	p := newTestProxy(t, upstream)
+
+	r := httptest.NewRequest(http.MethodGet, "/index/_search", strings.NewReader(query))
+	r.Header.Set("Content-Type", "application/json")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+
+	// checkSignature has verified the body is covered by the signature
+	received := <-got
+	if string(received.body) != query {
+		t.Errorf("upstream got body %q, want %q", received.body, query)
+	}
+	if received.req.ContentLength != int64(len(query)) {
+		t.Errorf("upstream got Content-Length %d, want %d", received.req.ContentLength, len(query))
+	}
+}
+
+// countingProvider hands out static credentials, counting how often they
+// are fetched. Fetching takes a while, like a call to STS would.
+type countingProvider struct {
+	calls int32
+}
+
+func (c *countingProvider) Retrieve() (credentials.Value, error) {
+	atomic.AddInt32(&c.calls, 1)
+	time.Sleep(50 * time.Millisecond)
+	return testCredentials.Get()
+}
+
+func (c *countingProvider) IsExpired() bool {
+	return false
+}
+
+func TestServeHTTPConcurrentExpiry(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checkSignature(t, r, nil)
+	}))
+	defer upstream.Close()
+
+	provider := &countingProvider{}
+	creds := credentials.NewCredentials(provider)
+	p := newTestProxy(t, upstream)
+	p.Credentials, p.Signer = creds, v4.NewSigner(creds)
+
+	// Sign once, then let every request find the credentials expired
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	creds.Expire()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_cluster/health", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&provider.calls); calls != 2 {
+		t.Errorf("credentials fetched %d times, want once at first and once after expiring", calls)
+	}
+}
+
+func TestServeHTTPAuthzMethodOverride(t *testing.T) {
+	var asked authzRequest
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&asked); err != nil {
+			t.Errorf("decoding hook request: %s", err)
+		}
+		if asked.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer hook.Close()
+
+	upstream, got := recordingUpstream(t, http.StatusOK, "{}")
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	p.MethodOverrides = []string{"DELETE"}
+	p.Authz = newAuthzHook(hook.URL, nil, 0)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/logs", nil)
+	r.Header.Set("X-HTTP-Method-Override", "DELETE")
+	p.ServeHTTP(w, r)
+
+	if asked.Method != http.MethodDelete || asked.Path != "/logs" {
+		t.Errorf("hook was asked about %s %s, want DELETE /logs", asked.Method, asked.Path)
+	}
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", w.Code)
+	}
+	select {
+	case received := <-got:
+		t.Errorf("upstream got %s %s, want nothing", received.req.Method, received.req.URL.Path)
+	default:
+	}
+}
+
+func TestServeHTTPTruncatedResponse(t *testing.T) {
+	// Promising more than is sent makes the server drop the connection
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte(`{"hits":{"hits":[`))
+	}))
+	defer upstream.Close()
+
+	front := httptest.NewServer(newTestProxy(t, upstream))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL + "/logs/_search")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if body, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Errorf("client got a complete response with status %d and body %q, want the connection dropped", resp.StatusCode, body)
+	}
+}
+
+func TestServeHTTPMaxIndicesAll(t *testing.T) {
+	upstream, _ := recordingUpstream(t, http.StatusOK, "{}")
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	p.MaxIndicesPerRequest = 2
+	p.indices.Store([]string{"logs-1", "logs-2", "logs-3", "metrics"})
+
+	for _, path := range []string{"/_all/_search", "/_search", "/_count", "/*/_search", "/logs-*/_search"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", path, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/logs-1,metrics/_search", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/logs-1,metrics/_search: status = %d, want 200", w.Code)
+	}
+}
+
+func TestServeHTTPLogsRoleIdentity(t *testing.T) {
+	const (
+		proxyARN = "arn:aws:iam::123456789012:user/proxy"
+		roleARN  = "arn:aws:iam::123456789012:role/reader"
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	p.Recent = newRecentLog(10)
+	p.Identity = &callerIdentity{creds: testCredentials, accessKeyID: "AKIDEXAMPLE", arn: proxyARN}
+	p.RoleHeader = "X-Role"
+	p.Roles = newRoleSigners(nil, []string{roleARN}, nil)
+	p.Roles.signers[roleARN] = v4.NewSigner(testCredentials)
+
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/logs/_search", nil))
+	r := httptest.NewRequest(http.MethodGet, "/logs/_search", nil)
+	r.Header.Set("X-Role", roleARN)
+	p.ServeHTTP(httptest.NewRecorder(), r)
+
+	entries := p.Recent.list()
+	if len(entries) != 2 {
+		t.Fatalf("got %d log entries, want 2", len(entries))
+	}
+	if entries[0].Identity != proxyARN {
+		t.Errorf("request without a role logged as %q, want %q", entries[0].Identity, proxyARN)
+	}
+	if entries[1].Identity != roleARN {
+		t.Errorf("request with a role logged as %q, want %q", entries[1].Identity, roleARN)
+	}
+}
+
+func TestServeHTTPCaptureRedact(t *testing.T) {
+	upstream, _ := recordingUpstream(t, http.StatusOK, "{}")
+	defer upstream.Close()
+
+	var captured bytes.Buffer
+	p := newTestProxy(t, upstream)
+	p.Capture = log.New(&captured, "", 0)
+	p.CaptureHeaders = []string{"Content-Type", "X-Api-Key"}
+	p.CaptureMaxBody = 1024
+	p.CaptureRedact = []*regexp.Regexp{
+		regexp.MustCompile(`"password":"[^"]*"`),
+		regexp.MustCompile(`^secret-.*`),
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/users/_doc", strings.NewReader(`{"user":"kimchy","password":"hunter2"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Api-Key", "secret-123")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+
+	var rec captureRecord
+	if err := json.Unmarshal(captured.Bytes(), &rec); err != nil {
+		t.Fatalf("decoding capture record %q: %s", captured.String(), err)
+	}
+	if want := `{"user":"kimchy",[REDACTED]}`; rec.Body != want {
+		t.Errorf("captured body %q, want %q", rec.Body, want)
+	}
+	if rec.Headers["X-Api-Key"] != "[REDACTED]" || rec.Headers["Content-Type"] != "application/json" {
+		t.Errorf("captured headers %v, want X-Api-Key masked", rec.Headers)
+	}
+	if strings.Contains(captured.String(), "hunter2") || strings.Contains(captured.String(), "secret-123") {
+		t.Errorf("capture file leaks a secret: %s", captured.String())
+	}
+}
+
+func TestServeHTTPPassthroughSigned(t *testing.T) {
+	const auth = "AWS4-HMAC-SHA256 Credential=AKIDCLIENT/20240101/us-east-1/es/aws4_request, SignedHeaders=host;x-amz-date, Signature=0123456789abcdef"
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if got := r.Header.Get("Authorization"); got != auth {
+			t.Errorf("upstream got %s %s signed with %q, want the client's signature", r.Method, r.URL.Path, got)
+		}
+		if r.URL.Path == "/old/_search" {
+			http.Redirect(w, r, "/new/_search", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	p.PassthroughSigned = true
+	p.FollowRedirects = true
+	p.Client.CheckRedirect = p.checkRedirect
+	p.MetaCache = newMetaCache(time.Minute)
+
+	send := func(path string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Authorization", auth)
+		r.Header.Set("X-Amz-Date", "20240101T000000Z")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		if code := send("/old/_search"); code != http.StatusTemporaryRedirect {
+			t.Errorf("status = %d, want the redirect handed back", code)
+		}
+		if n := atomic.LoadInt32(&calls); n != 1 {
+			t.Errorf("upstream got %d requests, want 1", n)
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		send("/_cluster/health")
+		send("/_cluster/health")
+		if n := atomic.LoadInt32(&calls); n != 2 {
+			t.Errorf("upstream got %d requests, want both sent with their signature", n)
+		}
+	})
+}
+
+func TestServeHTTPReadyWhileDraining(t *testing.T) {
+	upstream, got := recordingUpstream(t, http.StatusOK, `{"status":"green"}`)
+	defer upstream.Close()
+
+	p := newTestProxy(t, upstream)
+	p.ReadyStatuses = []string{"green"}
+	p.startDraining()
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/_ready status = %d, want 503", w.Code)
+	}
+
+	// Requests are still forwarded until the server shuts down
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/logs/_search", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("search status = %d, want 200", w.Code)
+	}
+	if received := <-got; received.req.URL.Path != "/logs/_search" {
+		t.Errorf("upstream got %s, want /logs/_search", received.req.URL.Path)
+	}
+}
+
+func TestServeHTTPReady(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		body   string
+		want   int
+	}{
+		{http.StatusOK, `{"status":"green"}`, http.StatusOK},
+		{http.StatusOK, `{"status":"red"}`, http.StatusServiceUnavailable},
+		{http.StatusOK, `not json`, http.StatusServiceUnavailable},
+		{http.StatusInternalServerError, `{"status":"green"}`, http.StatusServiceUnavailable},
+	} {
+		upstream, got := recordingUpstream(t, tc.status, tc.body)
+		p := newTestProxy(t, upstream)
+		p.ReadyStatuses = []string{"green", "yellow"}
+
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_ready", nil))
+		if w.Code != tc.want {
+			t.Errorf("cluster health %d %s: status = %d, want %d", tc.status, tc.body, w.Code, tc.want)
+		}
+		if received := <-got; received.req.URL.Path != "/_cluster/health" {
+			t.Errorf("upstream got %s, want /_cluster/health", received.req.URL.Path)
+		}
+		upstream.Close()
+	}
+}
@@ -1,17 +1,20 @@
 #!/bin/bash
 
 VERSION="0.4"
+COMMIT=$(git rev-parse --short HEAD)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+LDFLAGS="-X main.version=${VERSION} -X main.commit=${COMMIT} -X main.buildDate=${BUILD_DATE}"
 
 rm -rf dist; mkdir -p dist
 for GOOS in darwin linux windows; do
   for GOARCH in 386 amd64; do
     echo "Building $GOOS-$GOARCH"
     if [[ $GOOS == "windows" ]]; then
-       env GOOS=$GOOS GOARCH=$GOARCH go build -o dist/aws-es-proxy-${VERSION}-${GOOS}-${GOARCH}.exe
+       env GOOS=$GOOS GOARCH=$GOARCH go build -ldflags "${LDFLAGS}" -o dist/aws-es-proxy-${VERSION}-${GOOS}-${GOARCH}.exe
      elif [[ $GOOS == "darwin" ]]; then
-       env GOOS=$GOOS GOARCH=$GOARCH go build -o dist/aws-es-proxy-${VERSION}-mac-${GOARCH}
+       env GOOS=$GOOS GOARCH=$GOARCH go build -ldflags "${LDFLAGS}" -o dist/aws-es-proxy-${VERSION}-mac-${GOARCH}
     else
-      env GOOS=$GOOS GOARCH=$GOARCH go build -o dist/aws-es-proxy-${VERSION}-${GOOS}-${GOARCH}
+      env GOOS=$GOOS GOARCH=$GOARCH go build -ldflags "${LDFLAGS}" -o dist/aws-es-proxy-${VERSION}-${GOOS}-${GOARCH}
     fi
   done
 done
@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// newSyslogWriter connects to the local syslog daemon, or to a remote one
+// when address is given as e.g. udp://logs.example.com:514
+func newSyslogWriter(address, facility, tag string) (io.Writer, error) {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+
+	var network, raddr string
+	if address != "" {
+		link, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		network, raddr = link.Scheme, link.Host
+	}
+
+	return syslog.Dial(network, raddr, priority|syslog.LOG_INFO, tag)
+}
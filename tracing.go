@@ -0,0 +1,26 @@
+//go:build !otel
+// +build !otel
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Tracing is compiled in only with -tags otel, keeping the OpenTelemetry
+// dependencies out of regular builds.
+
+func setupTracing(endpoint string) error {
+	if endpoint != "" {
+		return errors.New("built without OpenTelemetry support, rebuild with -tags otel")
+	}
+	return nil
+}
+
+func startSpan(r *http.Request) (context.Context, func(status int)) {
+	return r.Context(), func(int) {}
+}
+
+func injectTrace(ctx context.Context, h http.Header) {}